@@ -69,6 +69,77 @@ func main() {
 			return
 		}
 		fmt.Println("镜像程序已关闭")
+	case "reload":
+		data, err := os.ReadFile("pid")
+		if err != nil {
+			fmt.Println("read pid error", err.Error())
+			return
+		}
+		pid, err := strconv.Atoi(string(data))
+		if err != nil {
+			fmt.Println("read pid error", err.Error())
+			return
+		}
+		if runtime.GOOS == "windows" {
+			fmt.Println("windows 不支持 reload，请在后台点击重新加载配置")
+			return
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			fmt.Println("find process error", err.Error())
+			return
+		}
+		err = process.Signal(syscall.SIGHUP)
+		if err != nil {
+			fmt.Println("process.Signal error", err.Error())
+			return
+		}
+		fmt.Println("已通知镜像程序重新加载配置")
+	case "passwd":
+		if len(os.Args) != 4 {
+			fmt.Println("用法: passwd 用户名 密码")
+			return
+		}
+		if err := pkg.InitTable(); err != nil {
+			fmt.Println("init table error", err.Error())
+			return
+		}
+		dao, err := pkg.NewDao()
+		if err != nil {
+			fmt.Println("数据库错误", err.Error())
+			return
+		}
+		if err = pkg.SetAdminPassword(dao, os.Args[2], os.Args[3]); err != nil {
+			fmt.Println("修改密码失败", err.Error())
+			return
+		}
+		fmt.Println("密码已修改")
+	case "migrate":
+		if len(os.Args) != 3 || (os.Args[2] != "status" && os.Args[2] != "up") {
+			fmt.Println("用法: migrate status|up")
+			return
+		}
+		if os.Args[2] == "up" {
+			if err := pkg.InitTable(); err != nil {
+				fmt.Println("数据库迁移失败", err.Error())
+				return
+			}
+		}
+		status, err := pkg.GetMigrationStatus()
+		if err != nil {
+			fmt.Println("数据库错误", err.Error())
+			return
+		}
+		for _, item := range status {
+			applied := "未执行"
+			if item.AppliedTime > 0 {
+				applied = time.Unix(item.AppliedTime, 0).Format("2006-01-02 15:04:05")
+			}
+			if item.Name == "" {
+				item.Name = "-"
+			}
+			fmt.Printf("%4d  %-40s %s\n", item.Version, item.Name, applied)
+		}
 
 	}
 }
@@ -92,6 +163,10 @@ func startCmd() {
 		logger.Error("parse config error", err.Error())
 		return
 	}
+	if err = appConfig.Validate(); err != nil {
+		logger.Error("config error", err.Error())
+		return
+	}
 	//繁体
 	s2t, err := gocc.New("s2t")
 	if err != nil {
@@ -113,12 +188,19 @@ func startCmd() {
 		logger.Error("GetIPList", err.Error())
 	}
 	app := &pkg.Application{
-		AppConfig: &appConfig,
-		Dao:       dao,
-		S2T:       s2t,
-		IpList:    ipList,
-		Logger:    logger,
+		Dao:    dao,
+		S2T:    s2t,
+		IpList: ipList,
+		Logger: logger,
 	}
+	app.SetConfig(&appConfig)
+	cacheStore, err := pkg.NewCacheStore(&appConfig)
+	if err != nil {
+		logger.Error("缓存配置错误", err.Error())
+		return
+	}
+	app.SetCacheStore(cacheStore)
+	app.SetHtmlCache(pkg.NewHtmlCache(appConfig.HtmlCacheSize * 1024 * 1024))
 	for i := range siteConfigs {
 
 		err = app.MakeSite(siteConfigs[i])
@@ -136,10 +218,21 @@ func startCmd() {
 	// 捕获kill的信号
 	sigTERM := make(chan os.Signal, 1)
 	signal.Notify(sigTERM, syscall.SIGTERM, syscall.Signal(16))
+	// SIGHUP 重新加载配置
+	sigHUP := make(chan os.Signal, 1)
+	signal.Notify(sigHUP, syscall.SIGHUP)
 	// 收到信号前会一直阻塞
-
-	<-sigTERM
-	app.Stop()
-	logger.Info("exit")
+	for {
+		select {
+		case <-sigHUP:
+			if err := app.Reload(); err != nil {
+				logger.Error("reload error", err.Error())
+			}
+		case <-sigTERM:
+			app.Stop()
+			logger.Info("exit")
+			return
+		}
+	}
 
 }
@@ -8,6 +8,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/wenzhenxi/gorsa v0.0.0-20230530123828-0320cce15d81
 	github.com/xuri/excelize/v2 v2.8.1
+	golang.org/x/crypto v0.22.0
 	golang.org/x/net v0.24.0
 )
 
@@ -19,7 +20,6 @@ require (
 	github.com/richardlehane/msoleps v1.0.3 // indirect
 	github.com/xuri/efp v0.0.0-20231025114914-d1ff6096ae53 // indirect
 	github.com/xuri/nfp v0.0.0-20230919160717-d98342af3f05 // indirect
-	golang.org/x/crypto v0.22.0 // indirect
 )
 
 require (
@@ -1,10 +1,13 @@
 package pkg
 
 import (
-	"crypto/sha256"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -12,16 +15,18 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/xuri/excelize/v2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type AdminModule struct {
 	dao      *Dao
 	app      *Application
 	adminMux *http.ServeMux
-	UserName string
-	Password string
 	prefix   string
+	sessions *sessionStore
+	limiter  *loginLimiter
+	//metrics 使用的缓存占用
+	cacheUsage cacheStatsCache
 }
 type AdminUser struct {
 	UserName string `json:"user_name"`
@@ -29,12 +34,23 @@ type AdminUser struct {
 }
 
 func NewAdmin(app *Application) *AdminModule {
-	userName, password, err := makeAdminUser()
+	userName, initPassword, err := makeAdminUser(app.Dao)
 	if err != nil {
 		app.Logger.Fatal("make admin user error", err.Error())
 		os.Exit(1)
 	}
-	admin := &AdminModule{dao: app.Dao, app: app, prefix: app.AdminUri, UserName: userName, Password: password}
+	if initPassword != "" {
+		//密码只输出到标准错误一次，不写入日志文件
+		fmt.Fprintf(os.Stderr, "已生成后台账号 %s 密码 %s，请登录后修改\n", userName, initPassword)
+		app.Logger.Warn(fmt.Sprintf("已生成后台账号 %s，密码已输出到标准错误，请登录后修改", userName))
+	}
+	admin := &AdminModule{
+		dao:      app.Dao,
+		app:      app,
+		prefix:   app.Config().AdminUri,
+		sessions: newSessionStore(),
+		limiter:  newLoginLimiter(),
+	}
 	admin.Initialize()
 	return admin
 }
@@ -51,41 +67,142 @@ func (admin *AdminModule) Initialize() {
 	}))
 	admin.adminMux.Handle("/static/", fileHandler)
 	admin.adminMux.Handle(prefix+"/login", admin.AuthMiddleware(admin.login))
+	admin.adminMux.Handle(prefix+"/logout", admin.AuthMiddleware(admin.logout))
+	admin.adminMux.Handle(prefix+"/change_password", admin.AuthMiddleware(admin.changePassword))
 	admin.adminMux.Handle(prefix, admin.AuthMiddleware(admin.index))
 	admin.adminMux.Handle(prefix+"/site", admin.AuthMiddleware(admin.site))
 	admin.adminMux.Handle(prefix+"/record", admin.AuthMiddleware(admin.record))
+	admin.adminMux.Handle(prefix+"/recordList", admin.AuthMiddleware(admin.recordList))
+	admin.adminMux.Handle(prefix+"/del_record", admin.RoleMiddleware(RoleAdmin, admin.delRecord))
+	admin.adminMux.Handle(prefix+"/record_stats", admin.AuthMiddleware(admin.recordStats))
 
 	admin.adminMux.Handle(prefix+"/list", admin.AuthMiddleware(admin.siteList))
 	admin.adminMux.Handle(prefix+"/edit", admin.AuthMiddleware(admin.editSite))
 
-	admin.adminMux.Handle(prefix+"/save_config", admin.AuthMiddleware(admin.siteSave))
-	admin.adminMux.Handle(prefix+"/delete", admin.AuthMiddleware(admin.siteDelete))
+	admin.adminMux.Handle(prefix+"/save_config", admin.RoleMiddleware(RoleEditor, admin.siteSave))
+	admin.adminMux.Handle(prefix+"/delete", admin.RoleMiddleware(RoleEditor, admin.siteDelete))
 
-	admin.adminMux.Handle(prefix+"/import", admin.AuthMiddleware(admin.siteImport))
-	admin.adminMux.Handle(prefix+"/delete_cache", admin.AuthMiddleware(admin.DeleteCache))
-	admin.adminMux.Handle(prefix+"/multi_del", admin.AuthMiddleware(admin.multiDel))
-	admin.adminMux.Handle(prefix+"/forbidden_words", admin.AuthMiddleware(admin.forbiddenWords))
+	admin.adminMux.Handle(prefix+"/import", admin.RoleMiddleware(RoleEditor, admin.siteImport))
+	admin.adminMux.Handle(prefix+"/export", admin.AuthMiddleware(admin.siteExport))
+	admin.adminMux.Handle(prefix+"/delete_cache", admin.RoleMiddleware(RoleEditor, admin.DeleteCache))
+	admin.adminMux.Handle(prefix+"/cache_stats", admin.AuthMiddleware(admin.cacheStats))
+	admin.adminMux.Handle(prefix+"/multi_del", admin.RoleMiddleware(RoleEditor, admin.multiDel))
+	admin.adminMux.Handle(prefix+"/forbidden_words", admin.RoleMiddleware(RoleAdmin, admin.forbiddenWords))
 	admin.adminMux.Handle(prefix+"/base_config", admin.AuthMiddleware(admin.baseConfig))
-	admin.adminMux.Handle(prefix+"/save_base_config", admin.AuthMiddleware(admin.saveBaseConfig))
+	admin.adminMux.Handle(prefix+"/save_base_config", admin.RoleMiddleware(RoleAdmin, admin.saveBaseConfig))
+	admin.adminMux.Handle(prefix+"/reload", admin.RoleMiddleware(RoleAdmin, admin.reload))
+
+	admin.adminMux.Handle(prefix+"/tokens", admin.AuthMiddleware(admin.tokens))
+	admin.adminMux.Handle(prefix+"/token_list", admin.AuthMiddleware(admin.tokenList))
+	admin.adminMux.Handle(prefix+"/token_create", admin.AuthMiddleware(admin.tokenCreate))
+	admin.adminMux.Handle(prefix+"/token_delete", admin.AuthMiddleware(admin.tokenDelete))
+
+	admin.adminMux.Handle(apiPrefix+"/openapi.json", http.HandlerFunc(admin.openapi))
+	admin.adminMux.Handle("/metrics", admin.ApiMiddleware(RoleViewer, admin.metrics))
+	admin.adminMux.Handle(apiPrefix+"/sites", admin.ApiMiddleware(RoleViewer, admin.apiSites))
+	admin.adminMux.Handle(apiPrefix+"/sites/", admin.ApiMiddleware(RoleViewer, admin.apiSites))
+
+	admin.adminMux.Handle(prefix+"/audit", admin.AuthMiddleware(admin.auditPage))
+	admin.adminMux.Handle(prefix+"/audit_list", admin.AuthMiddleware(admin.auditList))
+	admin.adminMux.Handle(prefix+"/audit_revert", admin.RoleMiddleware(RoleEditor, admin.auditRevert))
+
+	admin.adminMux.Handle(prefix+"/users", admin.RoleMiddleware(RoleAdmin, admin.users))
+	admin.adminMux.Handle(prefix+"/user_list", admin.RoleMiddleware(RoleAdmin, admin.userList))
+	admin.adminMux.Handle(prefix+"/user_save", admin.RoleMiddleware(RoleAdmin, admin.userSave))
+	admin.adminMux.Handle(prefix+"/user_delete", admin.RoleMiddleware(RoleAdmin, admin.userDelete))
 
 }
 
+// currentUser 返回已登录的用户，未登录或用户已删除返回nil
+func (admin *AdminModule) currentUser(r *http.Request) *AdminAccount {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	userName, ok := admin.sessions.Get(cookie.Value)
+	if !ok {
+		return nil
+	}
+	account, err := admin.dao.GetUser(userName)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			admin.app.Logger.Error("get admin user error", userName, err.Error())
+		}
+		return nil
+	}
+	return account
+}
+
+// requestUser 返回 AuthMiddleware 保存的当前用户
+func requestUser(r *http.Request) *AdminAccount {
+	account, _ := r.Context().Value(ADMIN_USER).(*AdminAccount)
+	return account
+}
+
+// AuthMiddleware 需要登录，所有角色都可以访问
 func (admin *AdminModule) AuthMiddleware(h func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return admin.RoleMiddleware(RoleViewer, h)
+}
+
+// RoleMiddleware 需要登录并且角色不低于 role
+func (admin *AdminModule) RoleMiddleware(role string, h func(w http.ResponseWriter, r *http.Request)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, _ := r.Cookie("login_cert")
-		sum := sha256.New().Sum([]byte(admin.UserName + admin.Password))
-		loginSign := fmt.Sprintf("%x", sum)
-		if r.URL.Path != admin.prefix+"/login" && (cookie == nil || cookie.Value != loginSign) {
-			http.Redirect(w, r, admin.prefix+"/login", http.StatusMovedPermanently)
+		account := admin.currentUser(r)
+		if r.URL.Path != admin.prefix+"/login" && account == nil {
+			http.Redirect(w, r, admin.prefix+"/login", http.StatusFound)
 			return
 		}
-		if r.URL.Path == admin.prefix+"/login" && cookie != nil && cookie.Value == loginSign {
-			http.Redirect(w, r, admin.prefix, http.StatusMovedPermanently)
+		if r.URL.Path == admin.prefix+"/login" && account != nil {
+			http.Redirect(w, r, admin.prefix, http.StatusFound)
 			return
 		}
+		if account != nil && !account.HasRole(role) {
+			writeForbidden(w, "没有权限")
+			return
+		}
+		if account != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ADMIN_USER, account))
+		}
 		h(w, r)
 	})
 }
+
+// writeResult 返回 {"code":..,"msg":..}，msg 可能包含引号，不能直接拼接字符串
+func writeResult(writer http.ResponseWriter, code int, msg string) {
+	data, _ := json.Marshal(map[string]interface{}{"code": code, "msg": msg})
+	_, _ = writer.Write(data)
+}
+
+func writeForbidden(writer http.ResponseWriter, msg string) {
+	data, _ := json.Marshal(map[string]interface{}{"code": 403, "msg": msg})
+	writer.WriteHeader(http.StatusForbidden)
+	_, _ = writer.Write(data)
+}
+
+// checkDomains 当前用户不能修改其中任意一个域名时返回403
+func (admin *AdminModule) checkDomains(writer http.ResponseWriter, request *http.Request, domains ...string) bool {
+	account := requestUser(request)
+	for _, domain := range domains {
+		if !account.CanEdit(domain) {
+			writeForbidden(writer, "没有域名 "+domain+" 的权限")
+			return false
+		}
+	}
+	return true
+}
+
+// checkRole 处理函数内再次检查角色，避免路由配置错误
+func (admin *AdminModule) checkRole(writer http.ResponseWriter, request *http.Request, role string) bool {
+	if !requestUser(request).HasRole(role) {
+		writeForbidden(writer, "没有权限")
+		return false
+	}
+	return true
+}
+
+// dummyPasswordHash 用户名错误时也做一次bcrypt比较，避免通过响应时间判断用户名是否存在
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("mirror-dummy-password"), bcrypt.DefaultCost)
+
 func (admin *AdminModule) login(writer http.ResponseWriter, request *http.Request) {
 	if request.Method == "GET" {
 		t := template.Must(template.New("login.html").ParseFiles("admin/login.html"))
@@ -95,47 +212,108 @@ func (admin *AdminModule) login(writer http.ResponseWriter, request *http.Reques
 		}
 		return
 	}
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 	var adminUser AdminUser
-	err := json.NewDecoder(request.Body).Decode(&adminUser)
+	err := json.NewDecoder(io.LimitReader(request.Body, 4096)).Decode(&adminUser)
 	if err != nil {
 		admin.app.Logger.Error("login ParseForm error", err.Error())
 		_, _ = writer.Write([]byte(`{"code":5,"msg":"参数错误"}`))
 		return
 	}
-
-	if adminUser.UserName == "" || adminUser.Password == "" || admin.UserName != adminUser.UserName || admin.Password != adminUser.Password {
+	ip := clientIP(request)
+	//按IP加用户名限制，不按用户名全局限制，否则任何人都可以用错误密码锁住管理员
+	limitKeys := []string{"ip:" + ip + "|user:" + adminUser.UserName}
+	if remain := admin.limiter.Locked(limitKeys...); remain > 0 {
+		result, _ := json.Marshal(map[string]interface{}{"code": 6, "msg": fmt.Sprintf("登录失败次数过多，请%d分钟后再试", int(remain.Minutes())+1)})
+		_, _ = writer.Write(result)
+		return
+	}
+	account, err := admin.dao.GetUser(adminUser.UserName)
+	if err != nil && err != sql.ErrNoRows {
+		admin.app.Logger.Error("get admin user error", err.Error())
+		_, _ = writer.Write([]byte(`{"code":3,"msg":"登录失败"}`))
+		return
+	}
+	userMatch := account != nil
+	passwordHash := dummyPasswordHash
+	if userMatch {
+		passwordHash = []byte(account.PasswordHash)
+	}
+	passwordErr := bcrypt.CompareHashAndPassword(passwordHash, []byte(adminUser.Password))
+	if adminUser.UserName == "" || adminUser.Password == "" || !userMatch || passwordErr != nil {
+		admin.limiter.Fail(limitKeys...)
+		admin.app.Logger.Warn("admin login failed", adminUser.UserName, ip)
 		_, _ = writer.Write([]byte(`{"code":4,"msg":"用户名或密码错误"}`))
 		return
 	}
-	sum := sha256.New().Sum([]byte(adminUser.UserName + adminUser.Password))
-	loginSign := fmt.Sprintf("%x", sum)
-	cookie := &http.Cookie{Name: "login_cert", Value: loginSign, HttpOnly: true, Path: "/"}
+	admin.limiter.Reset(limitKeys...)
+	token, err := admin.sessions.Create(adminUser.UserName)
+	if err != nil {
+		admin.app.Logger.Error("create session error", err.Error())
+		_, _ = writer.Write([]byte(`{"code":3,"msg":"登录失败"}`))
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessionTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
 	http.SetCookie(writer, cookie)
 	_, _ = writer.Write([]byte(`{"code":0,"msg":"登录成功"}`))
 }
+
+// logout 只接受POST，GET 可以被其他网站的图片链接触发
+func (admin *AdminModule) logout(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := request.Cookie(sessionCookieName); err == nil {
+		admin.sessions.Delete(cookie.Value)
+	}
+	http.SetCookie(writer, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	_, _ = writer.Write([]byte(`{"code":0,"msg":""}`))
+}
 func (admin *AdminModule) multiDel(writer http.ResponseWriter, request *http.Request) {
 	err := request.ParseForm()
 	if err != nil {
 		admin.app.Logger.Error("MulDel ParseForm error", err.Error())
 		_, _ = writer.Write([]byte(`{"code":5,"msg":"请求数据出错"}`))
+		return
 	}
 	domains := request.Form.Get("domains")
 	if domains == "" {
 		_, _ = writer.Write([]byte(`{"code":4,"msg":"域名不能为空"}`))
 		return
 	}
-	domainArr := strings.Split(domains, "\n")
-	err = admin.dao.MultiDel(domainArr)
-	if err != nil {
-		admin.app.Logger.Error("MulDel Dao error", err.Error())
-		_, _ = writer.Write([]byte(`{"code":4,"msg":"` + err.Error() + `"}`))
+	//CanEdit 按小写比较，域名统一转小写，和 siteDelete 一样逐个删除
+	domainArr := make([]string, 0)
+	for _, domain := range strings.Split(domains, "\n") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domainArr = append(domainArr, domain)
+		}
+	}
+	if !admin.checkDomains(writer, request, domainArr...) {
 		return
 	}
-	go func() {
-		for _, domain := range domainArr {
-			admin.deleteCache(domain)
+	for _, domain := range domainArr {
+		before := admin.siteSnapshot(domain)
+		if before == nil {
+			continue
 		}
-	}()
+		if err = admin.removeSite(request, before); err != nil {
+			admin.app.Logger.Error("MulDel Dao error", err.Error())
+			writeResult(writer, 4, err.Error())
+			return
+		}
+	}
 	_, _ = writer.Write([]byte(`{"code":0}`))
 
 }
@@ -145,7 +323,7 @@ func (admin *AdminModule) index(w http.ResponseWriter, request *http.Request) {
 		admin.app.Logger.Error("index template error", err.Error())
 		return
 	}
-	err = t.Execute(w, map[string]string{"admin_uri": admin.prefix, "ExpireDate": admin.app.ExpireDate})
+	err = t.Execute(w, map[string]interface{}{"admin_uri": admin.prefix, "ExpireDate": admin.app.ExpireDate, "user": requestUser(request)})
 	if err != nil {
 		admin.app.Logger.Error("index template error", err.Error())
 	}
@@ -156,7 +334,7 @@ func (admin *AdminModule) site(w http.ResponseWriter, request *http.Request) {
 		admin.app.Logger.Error("index template error", err.Error())
 		return
 	}
-	err = t.Execute(w, map[string]string{"admin_uri": admin.prefix, "ExpireDate": admin.app.ExpireDate})
+	err = t.Execute(w, map[string]interface{}{"admin_uri": admin.prefix, "ExpireDate": admin.app.ExpireDate, "user": requestUser(request)})
 	if err != nil {
 		admin.app.Logger.Error("index template error", err.Error())
 	}
@@ -172,8 +350,140 @@ func (admin *AdminModule) record(w http.ResponseWriter, request *http.Request) {
 		admin.app.Logger.Error("index template error", err.Error())
 	}
 }
+func (admin *AdminModule) recordList(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	var result = make(map[string]interface{})
+	p, err := strconv.Atoi(v.Get("page"))
+	if err != nil || p <= 0 {
+		p = 1
+	}
+	size, err := strconv.Atoi(v.Get("limit"))
+	if err != nil || size <= 0 {
+		size = 50
+	}
+	domain := strings.TrimSpace(v.Get("domain"))
+	startTime, err := ParseDateTime(v.Get("start_time"))
+	if err != nil {
+		result["code"] = 1
+		result["msg"] = "开始时间格式错误"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	endTime, err := ParseDateTime(v.Get("end_time"))
+	if err != nil {
+		result["code"] = 1
+		result["msg"] = "结束时间格式错误"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	records, err := admin.dao.GetRecordByPage(p, size, domain, startTime, endTime)
+	if err != nil {
+		result["code"] = 2
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	count, err := admin.dao.CountRecord(domain, startTime, endTime)
+	if err != nil {
+		result["code"] = 3
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	result["code"] = 0
+	result["msg"] = ""
+	result["count"] = count
+	result["data"] = records
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
+func (admin *AdminModule) recordStats(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	var result = make(map[string]interface{})
+	domain := strings.TrimSpace(v.Get("domain"))
+	startTime, err := ParseDateTime(v.Get("start_time"))
+	if err != nil {
+		result["code"] = 1
+		result["msg"] = "开始时间格式错误"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	endTime, err := ParseDateTime(v.Get("end_time"))
+	if err != nil {
+		result["code"] = 1
+		result["msg"] = "结束时间格式错误"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	stats, err := admin.dao.RecordStats(domain, startTime, endTime, 50)
+	if err != nil {
+		result["code"] = 2
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	result["code"] = 0
+	result["msg"] = ""
+	result["count"] = len(stats)
+	result["data"] = stats
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
+func (admin *AdminModule) delRecord(writer http.ResponseWriter, request *http.Request) {
+	if !admin.checkRole(writer, request, RoleAdmin) {
+		return
+	}
+	v := request.URL.Query()
+	var result = make(map[string]interface{})
+	startTime, err := ParseDateTime(v.Get("start_time"))
+	if err != nil || startTime == 0 {
+		result["code"] = 1
+		result["msg"] = "开始时间格式错误"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	endTime, err := ParseDateTime(v.Get("end_time"))
+	if err != nil || endTime == 0 {
+		result["code"] = 1
+		result["msg"] = "结束时间格式错误"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	if startTime > endTime {
+		result["code"] = 2
+		result["msg"] = "开始时间不能大于结束时间"
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	count, err := admin.dao.DeleteRecord(startTime, endTime)
+	if err != nil {
+		result["code"] = 3
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	result["code"] = 0
+	result["msg"] = ""
+	result["count"] = count
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
 
 func (admin *AdminModule) forbiddenWords(writer http.ResponseWriter, request *http.Request) {
+	if !admin.checkRole(writer, request, RoleAdmin) {
+		return
+	}
 	if request.Method == "GET" {
 		t := template.New("forbidden_words.html")
 		t = template.Must(t.ParseFiles("admin/forbidden_words.html"))
@@ -187,6 +497,7 @@ func (admin *AdminModule) forbiddenWords(writer http.ResponseWriter, request *ht
 	if err != nil {
 		admin.app.Logger.Error("forbiddenWords parseform error", err.Error())
 		_, _ = writer.Write([]byte(`{"code":5,"msg":"请求参数错误"}`))
+		return
 	}
 	forbiddenWord := request.Form.Get("forbidden_word")
 	replaceWord := request.Form.Get("replace_word")
@@ -195,19 +506,23 @@ func (admin *AdminModule) forbiddenWords(writer http.ResponseWriter, request *ht
 		_, _ = writer.Write([]byte(`{"code":2,"msg":"三个参数都要填"}`))
 		return
 	}
-	domainArr, err := admin.dao.ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord)
+	changes, err := admin.dao.ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord)
 	if err != nil {
 		admin.app.Logger.Error("forbiddenWords ForbiddenWordReplace error", err.Error())
-		_, _ = writer.Write([]byte(`{"code":3,"msg":"` + err.Error() + `"}`))
+		writeResult(writer, 3, err.Error())
 		return
 	}
-	for _, value := range domainArr {
-		da := strings.Split(value, "##")
-		admin.deleteCache(da[0])
-		un, ok := admin.app.Sites.Load(da[0])
+	for _, change := range changes {
+		admin.deleteCache(change.Domain)
+		un, ok := admin.app.Sites.Load(change.Domain)
 		if ok {
 			site := un.(*Site)
-			site.IndexTitle = da[1]
+			site.IndexTitle = change.NewTitle
+		}
+		if after := admin.siteSnapshot(change.Domain); after != nil {
+			before := *after
+			before.IndexTitle = change.OldTitle
+			admin.audit(request, AuditForbiddenWords, change.Domain, &before, after)
 		}
 	}
 	_, _ = writer.Write([]byte(`{"code":0,"msg":""}`))
@@ -229,7 +544,7 @@ func (admin *AdminModule) editSite(writer http.ResponseWriter, request *http.Req
 			return
 		}
 	}
-	err = t.Execute(writer, map[string]interface{}{"proxy_config": siteConfig, "admin_uri": admin.prefix})
+	err = t.Execute(writer, map[string]interface{}{"proxy_config": siteConfig, "upstream_headers": formatHeaderLines(siteConfig.Upstream.Headers), "upstream_origins": strings.Join(siteConfig.Upstream.Origins, "\n"), "admin_uri": admin.prefix})
 	if err != nil {
 		admin.app.Logger.Error("editSite template error", err.Error())
 	}
@@ -270,7 +585,7 @@ func (admin *AdminModule) siteList(writer http.ResponseWriter, request *http.Req
 		result["code"] = 0
 		result["msg"] = ""
 		result["count"] = 1
-		result["data"] = []SiteConfig{proxy}
+		result["data"] = admin.siteListItems([]SiteConfig{proxy})
 		data, _ := json.Marshal(result)
 		_, _ = writer.Write(data)
 		return
@@ -295,15 +610,36 @@ func (admin *AdminModule) siteList(writer http.ResponseWriter, request *http.Req
 	result["code"] = 0
 	result["msg"] = ""
 	result["count"] = count
-	result["data"] = proxys
+	result["data"] = admin.siteListItems(proxys)
 	data, _ := json.Marshal(result)
 	_, _ = writer.Write(data)
 
 }
+
+// siteListItem 后台站点列表的一行，附带每个源站的熔断和健康检查状态，站点没有加载时为null
+type siteListItem struct {
+	SiteConfig
+	OriginStatus []OriginStatus `json:"origin_status"`
+}
+
+func (admin *AdminModule) siteListItems(siteConfigs []SiteConfig) []siteListItem {
+	items := make([]siteListItem, 0, len(siteConfigs))
+	for _, siteConfig := range siteConfigs {
+		item := siteListItem{SiteConfig: siteConfig}
+		if value, ok := admin.app.Sites.Load(siteConfig.Domain); ok && value.(*Site).pool != nil {
+			for _, origin := range value.(*Site).pool.origins {
+				item.OriginStatus = append(item.OriginStatus, origin.Status())
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
 func (admin *AdminModule) siteSave(writer http.ResponseWriter, request *http.Request) {
 	err := request.ParseForm()
 	if err != nil {
 		_, _ = writer.Write([]byte(`{"code":5,"msg":"请求数据出错"}`))
+		return
 	}
 
 	id := request.Form.Get("id")
@@ -313,18 +649,30 @@ func (admin *AdminModule) siteSave(writer http.ResponseWriter, request *http.Req
 	if err != nil || cacheTime == 0 {
 		cacheTime = 1440
 	}
+	staleTime, err := strconv.ParseInt(request.Form.Get("stale_time"), 10, 64)
+	if err != nil || staleTime < 0 {
+		staleTime = 0
+	}
 	i, err := strconv.Atoi(id)
 	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
+		writeResult(writer, 2, err.Error())
 		return
 	}
-	if _, err := url.Parse(u); err != nil {
-		_, _ = writer.Write([]byte(`{"code":3,"msg":` + err.Error() + `}`))
+	if !admin.checkDomains(writer, request, domain) {
 		return
 	}
-	if _, err := url.Parse(domain); err != nil {
-		_, _ = writer.Write([]byte(`{"code":4,"msg":` + err.Error() + `}`))
-		return
+	var before *SiteConfig
+	if i != 0 {
+		//修改时原来的域名也要有权限，避免把别人的站点改成自己的域名
+		oldDomain, err := admin.dao.GetDomainById(i)
+		if err != nil {
+			writeResult(writer, 2, err.Error())
+			return
+		}
+		if !admin.checkDomains(writer, request, oldDomain) {
+			return
+		}
+		before = admin.siteSnapshot(oldDomain)
 	}
 	siteConfig := SiteConfig{
 		Id:               i,
@@ -334,32 +682,42 @@ func (admin *AdminModule) siteSave(writer http.ResponseWriter, request *http.Req
 		IndexTitle:       request.Form.Get("index_title"),
 		IndexKeywords:    request.Form.Get("index_keywords"),
 		IndexDescription: request.Form.Get("index_description"),
-		Finds:            strings.Split(request.Form.Get("finds"), ";"),
-		Replaces:         strings.Split(request.Form.Get("replaces"), ";"),
 		TitleReplace:     request.Form.Get("title_replace") == "on",
 		NeedJs:           request.Form.Get("need_js") == "on",
 		S2t:              request.Form.Get("s2t") == "on",
 		CacheEnable:      request.Form.Get("cache_enable") == "on",
 		CacheTime:        cacheTime,
+		StaleTime:        staleTime,
 		BaiduPushKey:     request.Form.Get("baidu_push_key"),
 		SmPushKey:        request.Form.Get("sm_push_key"),
 	}
-
-	if siteConfig.Id == 0 {
-		err = admin.dao.addOne(siteConfig)
+	//没有 rules 时兼容原来 ; 分隔的 finds、replaces
+	if rules := request.Form.Get("rules"); rules != "" {
+		if err = json.Unmarshal([]byte(rules), &siteConfig.Rules); err != nil {
+			writeResult(writer, 3, "替换规则格式错误: "+err.Error())
+			return
+		}
 	} else {
-		err = admin.dao.UpdateById(siteConfig)
+		siteConfig.Rules = legacyRules(strings.Split(request.Form.Get("finds"), ";"), strings.Split(request.Form.Get("replaces"), ";"))
 	}
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
+	if headerRules := request.Form.Get("header_rules"); headerRules != "" {
+		if err = json.Unmarshal([]byte(headerRules), &siteConfig.HeaderRules); err != nil {
+			writeResult(writer, 3, "响应头规则格式错误: "+err.Error())
+			return
+		}
+	}
+	if siteConfig.Upstream, err = upstreamFromForm(request); err != nil {
+		writeResult(writer, 3, err.Error())
 		return
 	}
-	err = admin.app.MakeSite(&siteConfig)
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
+	if err = validateSiteConfig(&siteConfig, before); err != nil {
+		writeResult(writer, 3, err.Error())
+		return
+	}
+	if _, err = admin.saveSite(request, before, siteConfig); err != nil {
+		writeResult(writer, 1, err.Error())
 		return
 	}
-
 	if siteConfig.Id == 0 {
 		_, _ = writer.Write([]byte("{\"code\":0,\"action\":\"add\"}"))
 		return
@@ -368,121 +726,184 @@ func (admin *AdminModule) siteSave(writer http.ResponseWriter, request *http.Req
 
 }
 
-func (admin *AdminModule) siteDelete(writer http.ResponseWriter, request *http.Request) {
-	q := request.URL.Query()
-	id := q.Get("id")
-	domain := q.Get("domain")
-	if domain == "" {
-		_, _ = writer.Write([]byte(`{"code":1,"msg":"域名不能为空"}`))
-		return
+// upstreamFromForm 读取后台表单里的回源设置，请求头每行一个，数字为空时是0
+func upstreamFromForm(request *http.Request) (UpstreamConfig, error) {
+	headers, err := parseHeaderLines(request.Form.Get("upstream_headers"))
+	if err != nil {
+		return UpstreamConfig{}, err
 	}
-	i, err := strconv.Atoi(id)
+	numbers := make(map[string]int64)
+	for _, name := range []string{"upstream_health_interval", "upstream_max_conns", "upstream_breaker_failures", "upstream_breaker_timeout"} {
+		value := strings.TrimSpace(request.Form.Get(name))
+		if value == "" {
+			continue
+		}
+		if numbers[name], err = strconv.ParseInt(value, 10, 32); err != nil {
+			return UpstreamConfig{}, fmt.Errorf("%s 必须是数字", name)
+		}
+	}
+	return UpstreamConfig{
+		Headers:         headers,
+		UserAgent:       request.Form.Get("upstream_user_agent"),
+		AcceptLanguage:  request.Form.Get("upstream_accept_language"),
+		CookiePolicy:    request.Form.Get("upstream_cookie_policy"),
+		AuthType:        request.Form.Get("upstream_auth_type"),
+		AuthUser:        request.Form.Get("upstream_auth_user"),
+		AuthPassword:    request.Form.Get("upstream_auth_password"),
+		AuthToken:       request.Form.Get("upstream_auth_token"),
+		Origins:         strings.Split(request.Form.Get("upstream_origins"), "\n"),
+		Balance:         request.Form.Get("upstream_balance"),
+		HealthPath:      request.Form.Get("upstream_health_path"),
+		HealthInterval:  numbers["upstream_health_interval"],
+		MaxConns:        int(numbers["upstream_max_conns"]),
+		BreakerFailures: int(numbers["upstream_breaker_failures"]),
+		BreakerTimeout:  numbers["upstream_breaker_timeout"],
+	}, nil
+}
+
+// validateSiteConfig 检查并整理站点配置，域名转成小写，before 是修改前的配置，用来还原隐藏的回源密码和令牌
+func validateSiteConfig(siteConfig *SiteConfig, before *SiteConfig) error {
+	siteConfig.Domain = strings.ToLower(strings.TrimSpace(siteConfig.Domain))
+	if siteConfig.Domain == "" {
+		return errors.New("域名不能为空")
+	}
+	if strings.ContainsAny(siteConfig.Domain, "/:?# ") || !strings.Contains(siteConfig.Domain, ".") {
+		return fmt.Errorf("域名 %s 格式错误", siteConfig.Domain)
+	}
+	siteConfig.Url = strings.TrimSpace(siteConfig.Url)
+	u, err := url.Parse(siteConfig.Url)
 	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
-		return
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("源站 %s 格式错误，需要 http:// 或 https:// 开头", siteConfig.Url)
+	}
+	if siteConfig.Rules == nil {
+		siteConfig.Rules = make([]ReplaceRule, 0)
+	}
+	if err = validateRules(siteConfig.Rules); err != nil {
+		return err
+	}
+	if siteConfig.HeaderRules == nil {
+		siteConfig.HeaderRules = make([]HeaderRule, 0)
+	}
+	if err = validateHeaderRules(siteConfig.HeaderRules); err != nil {
+		return err
+	}
+	if siteConfig.CacheTime < 0 || siteConfig.StaleTime < 0 {
+		return errors.New("缓存时间不能小于0")
+	}
+	var beforeUpstream *UpstreamConfig
+	if before != nil {
+		beforeUpstream = &before.Upstream
+	}
+	if err = siteConfig.Upstream.keepSecrets(beforeUpstream); err != nil {
+		return err
+	}
+	if err = validateUpstream(&siteConfig.Upstream); err != nil {
+		return err
+	}
+	for _, origin := range siteConfig.Upstream.Origins {
+		if origin == siteConfig.Url {
+			return fmt.Errorf("源站 %s 和镜像链接重复", origin)
+		}
+	}
+	return nil
+}
+
+// saveSite 保存站点配置并记录操作，before 为nil时新增，返回保存后的配置
+func (admin *AdminModule) saveSite(request *http.Request, before *SiteConfig, siteConfig SiteConfig) (*SiteConfig, error) {
+	var err error
+	if before == nil {
+		err = admin.dao.addOne(siteConfig)
+	} else {
+		siteConfig.Id = before.Id
+		err = admin.dao.UpdateById(siteConfig)
 	}
-	err = admin.dao.DeleteOne(i)
 	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
-		return
+		return nil, err
 	}
-	admin.app.Sites.Delete(domain)
-	admin.deleteCache(domain)
-	_, _ = writer.Write([]byte("{\"code\":0}"))
+	//MakeSite 会修改配置，先从数据库取修改后的配置
+	after := admin.siteSnapshot(siteConfig.Domain)
+	if before == nil {
+		admin.audit(request, AuditSiteAdd, siteConfig.Domain, nil, after)
+	} else if before.Domain != siteConfig.Domain {
+		//改了域名时按原域名记录删除，新域名记录新增，方便分别恢复
+		admin.app.deleteSite(before.Domain)
+		admin.audit(request, AuditSiteDelete, before.Domain, before, nil)
+		admin.audit(request, AuditSiteAdd, siteConfig.Domain, nil, after)
+	} else {
+		admin.audit(request, AuditSiteUpdate, siteConfig.Domain, before, after)
+	}
+	if err = admin.app.MakeSite(&siteConfig); err != nil {
+		return after, err
+	}
+	return after, nil
+}
 
+// removeSite 删除站点和缓存并记录操作
+func (admin *AdminModule) removeSite(request *http.Request, siteConfig *SiteConfig) error {
+	if err := admin.dao.DeleteOne(siteConfig.Id); err != nil {
+		return err
+	}
+	admin.app.deleteSite(siteConfig.Domain)
+	admin.deleteCache(siteConfig.Domain)
+	admin.audit(request, AuditSiteDelete, siteConfig.Domain, siteConfig, nil)
+	return nil
 }
 
-func (admin *AdminModule) siteImport(writer http.ResponseWriter, request *http.Request) {
-	err := request.ParseForm()
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":5,"msg":` + err.Error() + `}`))
+func (admin *AdminModule) siteDelete(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	id := q.Get("id")
+	domain := q.Get("domain")
+	if domain == "" {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"域名不能为空"}`))
 		return
 	}
-	mf, _, err := request.FormFile("file")
+	i, err := strconv.Atoi(id)
 	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
+		writeResult(writer, 1, err.Error())
 		return
 	}
-	defer mf.Close()
-
-	f, err := excelize.OpenReader(mf)
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
+	oldDomain, err := admin.dao.GetDomainById(i)
+	if err != nil || oldDomain != domain {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"站点不存在"}`))
 		return
 	}
-	rows, err := f.GetRows("Sheet1", excelize.Options{RawCellValue: true})
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":2,"msg":` + err.Error() + `}`))
+	if !admin.checkDomains(writer, request, domain) {
 		return
 	}
-	var configs = make([]*SiteConfig, 0)
-	for k, row := range rows {
-		if k == 0 {
-			continue
-		}
-		if _, err := url.Parse(row[1]); err != nil {
-			_, _ = writer.Write([]byte(`{"code":3,"msg":` + err.Error() + `}`))
-			return
-		}
-		if _, err := url.Parse(row[0]); err != nil {
-			_, _ = writer.Write([]byte(`{"code":4,"msg":` + err.Error() + `}`))
-			return
-		}
-		cacheTime, err := strconv.ParseInt(row[11], 10, 64)
-		if err != nil || cacheTime == 0 {
-			cacheTime = 88888888
-		}
-		var siteConfig = &SiteConfig{
-			Domain:           row[0],
-			Url:              row[1],
-			IndexTitle:       row[2],
-			IndexKeywords:    row[3],
-			IndexDescription: row[4],
-			Finds:            strings.Split(row[5], ";"),
-			Replaces:         strings.Split(row[6], ";"),
-			H1Replace:        row[7],
-			NeedJs:           row[8] != "0" && strings.ToLower(row[8]) != "false",
-			S2t:              row[9] != "0" && strings.ToLower(row[9]) != "false",
-			TitleReplace:     row[10] != "0" && strings.ToLower(row[10]) != "false",
-			CacheEnable:      true,
-			CacheTime:        cacheTime,
-			BaiduPushKey:     row[12],
-			SmPushKey:        row[13],
-		}
-		configs = append(configs, siteConfig)
-	}
-	err = admin.dao.AddMulti(configs)
-	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":5,"msg":` + err.Error() + `}`))
+	before := admin.siteSnapshot(domain)
+	if before == nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"站点不存在"}`))
 		return
 	}
-
-	for i := range configs {
-		err := admin.app.MakeSite(configs[i])
-		if err != nil {
-			admin.app.Logger.Error(err.Error())
-		}
+	if err = admin.removeSite(request, before); err != nil {
+		writeResult(writer, 1, err.Error())
+		return
 	}
 	_, _ = writer.Write([]byte("{\"code\":0}"))
+
 }
 
 func (admin *AdminModule) baseConfig(writer http.ResponseWriter, request *http.Request) {
 
 	t := template.New("config.html")
 	t = template.Must(t.ParseFiles("admin/config.html"))
+	appConfig := admin.app.Config()
 	friendLinks := ""
-	for k, v := range admin.app.FriendLinks {
+	for k, v := range appConfig.FriendLinks {
 		line := k + "||" + strings.Join(v, "||") + "\n"
 		friendLinks += line
 	}
 	domains := make([]string, 0)
-	for domain := range admin.app.AdDomains {
+	for domain := range appConfig.AdDomains {
 		domains = append(domains, domain)
 	}
 	err := t.Execute(writer, map[string]interface{}{
 		"admin_uri":    admin.prefix,
-		"inject_js":    admin.app.InjectJs,
-		"keywords":     strings.Join(admin.app.Keywords, "\n"),
+		"inject_js":    appConfig.InjectJs,
+		"keywords":     strings.Join(appConfig.Keywords, "\n"),
 		"friend_links": friendLinks,
 		"adDomains":    strings.Join(domains, "\n"),
 	})
@@ -491,10 +912,13 @@ func (admin *AdminModule) baseConfig(writer http.ResponseWriter, request *http.R
 	}
 }
 func (admin *AdminModule) saveBaseConfig(writer http.ResponseWriter, request *http.Request) {
+	if !admin.checkRole(writer, request, RoleAdmin) {
+		return
+	}
 	var params map[string]string
 	err := json.NewDecoder(request.Body).Decode(&params)
 	if err != nil {
-		_, _ = writer.Write([]byte(`{"code":1,"msg":` + err.Error() + `}`))
+		writeResult(writer, 1, err.Error())
 		return
 	}
 	action, ok := params["action"]
@@ -509,63 +933,91 @@ func (admin *AdminModule) saveBaseConfig(writer http.ResponseWriter, request *ht
 		return
 	}
 
+	//复制一份配置修改后整体替换，避免和正在处理的请求冲突
+	//加 reloadLock，否则同时重新加载时其中一边的修改会丢失
+	admin.app.reloadLock.Lock()
+	defer admin.app.reloadLock.Unlock()
+	appConfig := *admin.app.Config()
 	if action == "js_config" {
+		old, _ := os.ReadFile("config/inject.js")
 		err = os.WriteFile("config/inject.js", []byte(content), os.ModePerm)
 		if err != nil {
-			_, _ = writer.Write([]byte(`{"code":4,"msg":` + err.Error() + `}`))
+			writeResult(writer, 4, err.Error())
 			return
 		}
-		admin.app.InjectJs = content
+		appConfig.InjectJs = content
+		admin.app.SetConfig(&appConfig)
+		admin.audit(request, AuditBaseConfig, "", map[string]string{"action": action, "content": string(old)}, map[string]string{"action": action, "content": content})
 		_, _ = writer.Write([]byte(`{"code":0,"msg":"保存成功"}`))
 		return
 	}
 	if action == "keyword_config" {
 		content = strings.ReplaceAll(content, "\r", "")
+		old, _ := os.ReadFile("config/keywords.txt")
 		err = ioutil.WriteFile("config/keywords.txt", []byte(content), os.ModePerm)
 		if err != nil {
-			_, _ = writer.Write([]byte(`{"code":4,"msg":` + err.Error() + `}`))
+			writeResult(writer, 4, err.Error())
 			return
 		}
-		admin.app.Keywords = strings.Split(content, "\n")
+		appConfig.Keywords = strings.Split(content, "\n")
+		admin.app.SetConfig(&appConfig)
+		admin.audit(request, AuditBaseConfig, "", map[string]string{"action": action, "content": string(old)}, map[string]string{"action": action, "content": content})
 		_, _ = writer.Write([]byte(`{"code":0,"msg":"保存成功"}`))
 		return
 	}
 	if action == "friendlink_config" {
 		content = strings.ReplaceAll(content, "\r", "")
+		old, _ := os.ReadFile("config/links.txt")
 		err = os.WriteFile("config/links.txt", []byte(content), os.ModePerm)
 		if err != nil {
-			_, _ = writer.Write([]byte(`{"code":4,"msg":` + err.Error() + `}`))
+			writeResult(writer, 4, err.Error())
 			return
 		}
-		linkLines := strings.Split(content, "\n")
-		for _, line := range linkLines {
-			linkArr := strings.Split(line, "||")
-			if len(linkArr) < 2 {
-				continue
-			}
-			admin.app.FriendLinks[linkArr[0]] = linkArr[1:]
-		}
+		appConfig.FriendLinks = parseLinks(content)
+		admin.app.SetConfig(&appConfig)
+		admin.audit(request, AuditBaseConfig, "", map[string]string{"action": action, "content": string(old)}, map[string]string{"action": action, "content": content})
 		_, _ = writer.Write([]byte(`{"code":0,"msg":"保存成功"}`))
 		return
 	}
 	if action == "ad_domains_config" {
 		content = strings.ReplaceAll(content, "\r", "")
+		old, _ := os.ReadFile("config/ad_domains.txt")
 		err = os.WriteFile("config/ad_domains.txt", []byte(content), os.ModePerm)
 		if err != nil {
-			_, _ = writer.Write([]byte(`{"code":4,"msg":` + err.Error() + `}`))
+			writeResult(writer, 4, err.Error())
 			return
 		}
-		admin.app.AdDomains = make(map[string]bool)
+		appConfig.AdDomains = make(map[string]bool)
 		domains := strings.Split(content, "\n")
 		for _, domain := range domains {
-			admin.app.AdDomains[domain] = true
+			appConfig.AdDomains[domain] = true
 		}
+		admin.app.SetConfig(&appConfig)
+		admin.audit(request, AuditBaseConfig, "", map[string]string{"action": action, "content": string(old)}, map[string]string{"action": action, "content": content})
 		_, _ = writer.Write([]byte(`{"code":0,"msg":"保存成功"}`))
 		return
 	}
 
 }
 
+func (admin *AdminModule) reload(writer http.ResponseWriter, request *http.Request) {
+	if !admin.checkRole(writer, request, RoleAdmin) {
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	err := admin.app.Reload()
+	if err != nil {
+		admin.app.Logger.Error("reload error", err.Error())
+		data, _ := json.Marshal(map[string]interface{}{"code": 1, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	_, _ = writer.Write([]byte(`{"code":0,"msg":"重新加载成功"}`))
+}
+
 func (admin *AdminModule) DeleteCache(writer http.ResponseWriter, request *http.Request) {
 	q := request.URL.Query()
 	domain := q.Get("domain")
@@ -573,18 +1025,38 @@ func (admin *AdminModule) DeleteCache(writer http.ResponseWriter, request *http.
 		_, _ = writer.Write([]byte(`{"code":5,"msg":"域名不能为空"}`))
 		return
 	}
+	if !admin.checkDomains(writer, request, domain) {
+		return
+	}
 	admin.deleteCache(domain)
 	_, _ = writer.Write([]byte(`{"code":0}`))
 
 }
+func (admin *AdminModule) cacheStats(writer http.ResponseWriter, request *http.Request) {
+	var result = make(map[string]interface{})
+	stats, err := admin.app.CacheStore().Stats()
+	if err != nil {
+		result["code"] = 1
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	result["code"] = 0
+	result["msg"] = ""
+	result["data"] = stats
+	if htmlCache := admin.app.HtmlCache(); htmlCache != nil {
+		result["html"] = htmlCache.Stats()
+	}
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
 func (admin *AdminModule) deleteCache(domain string) {
 	if domain == "" {
 		return
 	}
-	dir := admin.app.CachePath + "/" + domain
-	if !isExist(dir) {
-		return
+	if err := admin.app.CacheStore().DeleteDomain(domain); err != nil {
+		admin.app.Logger.Error("delete cache error", domain, err.Error())
 	}
-	_ = os.RemoveAll(dir)
 
 }
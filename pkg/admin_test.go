@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAdmin(t *testing.T) (*AdminModule, string, string) {
+	t.Helper()
+	useTempDb(t)
+	if err := InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	dao, err := NewDao()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dao.Close() })
+	userName, password, err := makeAdminUser(dao)
+	if err != nil || password == "" {
+		t.Fatalf("make admin user: %q %v", password, err)
+	}
+	app := newTestApp(t)
+	app.Dao = dao
+	admin := &AdminModule{dao: dao, app: app, prefix: "/admin", sessions: newSessionStore(), limiter: newLoginLimiter()}
+	return admin, userName, password
+}
+
+func postLogin(admin *AdminModule, ip, userName, password string) string {
+	body := fmt.Sprintf(`{"user_name":%q,"password":%q}`, userName, password)
+	request := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(body))
+	request.RemoteAddr = ip + ":1234"
+	recorder := httptest.NewRecorder()
+	admin.login(recorder, request)
+	return recorder.Body.String()
+}
+
+func TestLoginThrottlePerIp(t *testing.T) {
+	admin, userName, password := newTestAdmin(t)
+	for i := 0; i < loginMaxFailures; i++ {
+		postLogin(admin, "192.0.2.1", userName, "wrong-password")
+	}
+	if result := postLogin(admin, "192.0.2.1", userName, password); !strings.Contains(result, `"code":6`) {
+		t.Fatalf("want the attacking IP locked, got %s", result)
+	}
+	//其他IP的管理员不受影响
+	if result := postLogin(admin, "192.0.2.2", userName, password); !strings.Contains(result, `"code":0`) {
+		t.Fatalf("admin should still log in from another IP, got %s", result)
+	}
+}
+
+func TestLogoutRequiresPost(t *testing.T) {
+	admin, _, _ := newTestAdmin(t)
+	token, err := admin.sessions.Create("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/admin/logout", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	recorder := httptest.NewRecorder()
+	admin.logout(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET logout got %d, want 405", recorder.Code)
+	}
+	if _, ok := admin.sessions.Get(token); !ok {
+		t.Fatal("GET must not end the session")
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/admin/logout", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	admin.logout(httptest.NewRecorder(), request)
+	if _, ok := admin.sessions.Get(token); ok {
+		t.Fatal("POST logout should end the session")
+	}
+}
+
+func TestGenUserAndPass(t *testing.T) {
+	user, pass, err := genUserAndPass()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user) != 8 || len(pass) != 12 {
+		t.Fatalf("got %q %q", user, pass)
+	}
+	if _, other, _ := genUserAndPass(); other == pass {
+		t.Fatal("passwords should differ")
+	}
+}
+
+func TestMultiDelRemovesSites(t *testing.T) {
+	admin, _, _ := newTestAdmin(t)
+	app := admin.app
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		siteConfig := &SiteConfig{Domain: domain, Url: "http://127.0.0.1:1"}
+		if err := admin.dao.addOne(*siteConfig); err != nil {
+			t.Fatal(err)
+		}
+		newTestSite(t, app, siteConfig)
+	}
+
+	//编辑只能管理 a.example.com，提交的域名大小写不一致
+	editor := &AdminAccount{UserName: "editor", Role: RoleEditor, Domains: []string{"a.example.com"}}
+	form := url.Values{"domains": {" A.Example.COM \n"}}
+	request := httptest.NewRequest(http.MethodPost, "/admin/multi_del", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request = request.WithContext(context.WithValue(request.Context(), ADMIN_USER, editor))
+	recorder := httptest.NewRecorder()
+	admin.multiDel(recorder, request)
+	if !strings.Contains(recorder.Body.String(), `"code":0`) {
+		t.Fatalf("multiDel: %s", recorder.Body.String())
+	}
+	if admin.siteSnapshot("a.example.com") != nil {
+		t.Fatal("site should be deleted from the database")
+	}
+	if _, ok := app.Sites.Load("a.example.com"); ok {
+		t.Fatal("site should stop serving after multiDel")
+	}
+	if _, ok := app.Sites.Load("b.example.com"); !ok || admin.siteSnapshot("b.example.com") == nil {
+		t.Fatal("other sites should be kept")
+	}
+}
+
+func TestSaveBaseConfigWaitsForReload(t *testing.T) {
+	admin, _, _ := newTestAdmin(t)
+	account := &AdminAccount{UserName: "admin", Role: RoleAdmin}
+	body := `{"action":"keyword_config","content":"a\nb"}`
+	request := httptest.NewRequest(http.MethodPost, "/admin/base_config", strings.NewReader(body))
+	request = request.WithContext(context.WithValue(request.Context(), ADMIN_USER, account))
+
+	//模拟正在重新加载
+	admin.app.reloadLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		admin.saveBaseConfig(httptest.NewRecorder(), request)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("saveBaseConfig should wait for the reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	admin.app.reloadLock.Unlock()
+	<-done
+	if keywords := admin.app.Config().Keywords; len(keywords) != 2 || keywords[1] != "b" {
+		t.Fatalf("keywords = %q", keywords)
+	}
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (admin *AdminModule) users(w http.ResponseWriter, request *http.Request) {
+	t, err := template.ParseFiles("admin/users.html")
+	if err != nil {
+		admin.app.Logger.Error("users template error", err.Error())
+		return
+	}
+	err = t.Execute(w, map[string]string{"admin_uri": admin.prefix})
+	if err != nil {
+		admin.app.Logger.Error("users template error", err.Error())
+	}
+}
+
+func (admin *AdminModule) userList(writer http.ResponseWriter, request *http.Request) {
+	var result = make(map[string]interface{})
+	accounts, err := admin.dao.GetUsers()
+	if err != nil {
+		result["code"] = 1
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	result["code"] = 0
+	result["msg"] = ""
+	result["count"] = len(accounts)
+	result["data"] = accounts
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
+
+// userSave 新增或修改用户，domains 每行一个域名，修改时密码为空表示不修改
+func (admin *AdminModule) userSave(writer http.ResponseWriter, request *http.Request) {
+	if !admin.checkRole(writer, request, RoleAdmin) {
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := request.ParseForm(); err != nil {
+		_, _ = writer.Write([]byte(`{"code":5,"msg":"请求数据出错"}`))
+		return
+	}
+	id, _ := strconv.Atoi(request.Form.Get("id"))
+	account := &AdminAccount{
+		Id:          id,
+		UserName:    strings.TrimSpace(request.Form.Get("user_name")),
+		Role:        request.Form.Get("role"),
+		Domains:     make([]string, 0),
+		CreatedTime: time.Now().Unix(),
+	}
+	for _, domain := range strings.Split(request.Form.Get("domains"), "\n") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			account.Domains = append(account.Domains, domain)
+		}
+	}
+	if !validRole(account.Role) {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"角色错误"}`))
+		return
+	}
+	if account.Id == 0 && (account.UserName == "" || strings.Contains(account.UserName, ":")) {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"用户名不能为空或包含:"}`))
+		return
+	}
+	var before *AdminAccount
+	if account.Id != 0 {
+		old, err := admin.dao.GetUserById(account.Id)
+		if err != nil {
+			_, _ = writer.Write([]byte(`{"code":1,"msg":"用户不存在"}`))
+			return
+		}
+		account.UserName = old.UserName
+		before = old
+	}
+	password := request.Form.Get("password")
+	if account.Id == 0 || password != "" {
+		if err := checkPassword(password); err != nil {
+			data, _ := json.Marshal(map[string]interface{}{"code": 2, "msg": err.Error()})
+			_, _ = writer.Write(data)
+			return
+		}
+		passwordHash, err := hashPassword(password)
+		if err != nil {
+			data, _ := json.Marshal(map[string]interface{}{"code": 2, "msg": err.Error()})
+			_, _ = writer.Write(data)
+			return
+		}
+		account.PasswordHash = passwordHash
+	}
+	current := requestUser(request)
+	if account.Id == current.Id && account.Role != RoleAdmin {
+		_, _ = writer.Write([]byte(`{"code":3,"msg":"不能取消自己的管理员角色"}`))
+		return
+	}
+	if err := admin.dao.SaveUser(account); err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 4, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	if account.PasswordHash != "" && account.Id != current.Id {
+		admin.sessions.DeleteUser(account.UserName)
+	}
+	admin.audit(request, AuditUserSave, "", before, account)
+	_, _ = writer.Write([]byte(`{"code":0}`))
+}
+
+func (admin *AdminModule) userDelete(writer http.ResponseWriter, request *http.Request) {
+	if !admin.checkRole(writer, request, RoleAdmin) {
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"参数错误"}`))
+		return
+	}
+	if id == requestUser(request).Id {
+		_, _ = writer.Write([]byte(`{"code":2,"msg":"不能删除自己"}`))
+		return
+	}
+	before, err := admin.dao.GetUserById(id)
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"用户不存在"}`))
+		return
+	}
+	if err = admin.dao.DeleteUser(id); err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 3, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	admin.audit(request, AuditUserDelete, "", before, nil)
+	_, _ = writer.Write([]byte(`{"code":0}`))
+}
+
+// changePassword 修改自己的密码，成功后所有会话需要重新登录
+func (admin *AdminModule) changePassword(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	account := requestUser(request)
+	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(request.FormValue("old_password"))); err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"原密码错误"}`))
+		return
+	}
+	newPassword := request.FormValue("new_password")
+	if err := checkPassword(newPassword); err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 2, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	passwordHash, err := hashPassword(newPassword)
+	if err == nil {
+		_, err = admin.dao.SetUserPassword(account.UserName, passwordHash)
+	}
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 3, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	admin.sessions.DeleteUser(account.UserName)
+	_, _ = writer.Write([]byte(`{"code":0}`))
+}
@@ -0,0 +1,310 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix = "/api/v1"
+	//请求体最大1MB
+	apiMaxBody = 1 << 20
+)
+
+// ApiToken 脚本调用接口用的令牌，权限和所属用户相同，数据库只保存sha256
+type ApiToken struct {
+	Id           int    `json:"id"`
+	UserId       int    `json:"user_id"`
+	Name         string `json:"name"`
+	CreatedTime  int64  `json:"created_time"`
+	LastUsedTime int64  `json:"last_used_time"`
+}
+
+func newTokenValue() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "mt_" + hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeApi 接口统一返回 {"code":..,"msg":..,"data":..}，出错时 code 和HTTP状态码相同
+func writeApi(writer http.ResponseWriter, status int, result map[string]interface{}) {
+	data, _ := json.Marshal(result)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(data)
+}
+
+func writeApiError(writer http.ResponseWriter, status int, msg string) {
+	writeApi(writer, status, map[string]interface{}{"code": status, "msg": msg})
+}
+
+// ApiMiddleware 接口认证，优先使用 Authorization: Bearer 令牌，没有令牌时使用后台登录会话
+func (admin *AdminModule) ApiMiddleware(role string, h func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		var account *AdminAccount
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+			if token == auth || token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeApiError(w, http.StatusUnauthorized, "Authorization 格式错误")
+				return
+			}
+			var err error
+			account, err = admin.dao.GetTokenUser(hashToken(token), time.Now().Unix())
+			if err != nil && err != sql.ErrNoRows {
+				admin.app.Logger.Error("get token user error", err.Error())
+			}
+		} else {
+			account = admin.currentUser(r)
+		}
+		if account == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeApiError(w, http.StatusUnauthorized, "未登录或令牌无效")
+			return
+		}
+		if !account.HasRole(role) {
+			writeForbidden(w, "没有权限")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), ADMIN_USER, account)))
+	})
+}
+
+func (admin *AdminModule) openapi(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	http.ServeFile(writer, request, "admin/openapi.json")
+}
+
+// apiSites /api/v1/sites 列表和新增，/api/v1/sites/{domain} 单个站点的查询、修改和删除
+func (admin *AdminModule) apiSites(writer http.ResponseWriter, request *http.Request) {
+	domain := strings.Trim(strings.TrimPrefix(request.URL.Path, apiPrefix+"/sites"), "/")
+	if request.Method != http.MethodGet && !requestUser(request).HasRole(RoleEditor) {
+		writeForbidden(writer, "没有权限")
+		return
+	}
+	if domain == "" {
+		switch request.Method {
+		case http.MethodGet:
+			admin.apiSiteList(writer, request)
+		case http.MethodPost:
+			admin.apiSiteCreate(writer, request)
+		default:
+			writer.Header().Set("Allow", "GET, POST")
+			writeApiError(writer, http.StatusMethodNotAllowed, "不支持的请求方法")
+		}
+		return
+	}
+	current := admin.siteSnapshot(domain)
+	if current == nil {
+		writeApiError(writer, http.StatusNotFound, "站点 "+domain+" 不存在")
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		writeApi(writer, http.StatusOK, map[string]interface{}{"code": 0, "msg": "", "data": current})
+	case http.MethodPut, http.MethodPatch:
+		admin.apiSiteUpdate(writer, request, current)
+	case http.MethodDelete:
+		if !admin.checkDomains(writer, request, current.Domain) {
+			return
+		}
+		if err := admin.removeSite(request, current); err != nil {
+			writeApiError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeApi(writer, http.StatusOK, map[string]interface{}{"code": 0, "msg": ""})
+	default:
+		writer.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeApiError(writer, http.StatusMethodNotAllowed, "不支持的请求方法")
+	}
+}
+
+func (admin *AdminModule) apiSiteList(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	page, err := strconv.Atoi(v.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(v.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 20
+	}
+	sites, err := admin.dao.GetByPage(page, limit)
+	if err != nil {
+		writeApiError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	count, err := admin.dao.Count()
+	if err != nil {
+		writeApiError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeApi(writer, http.StatusOK, map[string]interface{}{"code": 0, "msg": "", "count": count, "data": sites})
+}
+
+// decodeSite 读取请求体到 siteConfig，未知字段报错，避免字段名写错时被静默忽略
+func decodeSite(request *http.Request, siteConfig *SiteConfig) error {
+	decoder := json.NewDecoder(io.LimitReader(request.Body, apiMaxBody))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(siteConfig)
+}
+
+func (admin *AdminModule) apiSiteCreate(writer http.ResponseWriter, request *http.Request) {
+	siteConfig := SiteConfig{CacheEnable: true}
+	if err := decodeSite(request, &siteConfig); err != nil {
+		writeApiError(writer, http.StatusBadRequest, "请求数据错误: "+err.Error())
+		return
+	}
+	siteConfig.Id = 0
+	if siteConfig.CacheTime == 0 {
+		siteConfig.CacheTime = 1440
+	}
+	if err := validateSiteConfig(&siteConfig, nil); err != nil {
+		writeApiError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !admin.checkDomains(writer, request, siteConfig.Domain) {
+		return
+	}
+	if admin.siteSnapshot(siteConfig.Domain) != nil {
+		writeApiError(writer, http.StatusConflict, "站点 "+siteConfig.Domain+" 已存在")
+		return
+	}
+	after, err := admin.saveSite(request, nil, siteConfig)
+	if after == nil {
+		writeApiError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err != nil {
+		admin.app.Logger.Error("api make site error", siteConfig.Domain, err.Error())
+	}
+	writeApi(writer, http.StatusCreated, map[string]interface{}{"code": 0, "msg": "", "data": after})
+}
+
+// apiSiteUpdate PUT 整体替换，PATCH 只修改请求里有的字段，都不能修改域名
+func (admin *AdminModule) apiSiteUpdate(writer http.ResponseWriter, request *http.Request, current *SiteConfig) {
+	if !admin.checkDomains(writer, request, current.Domain) {
+		return
+	}
+	var siteConfig SiteConfig
+	if request.Method == http.MethodPatch {
+		siteConfig = *current
+	}
+	if err := decodeSite(request, &siteConfig); err != nil {
+		writeApiError(writer, http.StatusBadRequest, "请求数据错误: "+err.Error())
+		return
+	}
+	if siteConfig.Domain == "" {
+		siteConfig.Domain = current.Domain
+	}
+	if !strings.EqualFold(strings.TrimSpace(siteConfig.Domain), current.Domain) {
+		writeApiError(writer, http.StatusBadRequest, "不能修改域名，请删除后重新添加")
+		return
+	}
+	siteConfig.Id = current.Id
+	if siteConfig.CacheTime == 0 {
+		siteConfig.CacheTime = 1440
+	}
+	if err := validateSiteConfig(&siteConfig, current); err != nil {
+		writeApiError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	after, err := admin.saveSite(request, current, siteConfig)
+	if after == nil {
+		writeApiError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err != nil {
+		admin.app.Logger.Error("api make site error", siteConfig.Domain, err.Error())
+	}
+	writeApi(writer, http.StatusOK, map[string]interface{}{"code": 0, "msg": "", "data": after})
+}
+
+func (admin *AdminModule) tokens(w http.ResponseWriter, request *http.Request) {
+	t, err := template.ParseFiles("admin/tokens.html")
+	if err != nil {
+		admin.app.Logger.Error("tokens template error", err.Error())
+		return
+	}
+	err = t.Execute(w, map[string]string{"admin_uri": admin.prefix})
+	if err != nil {
+		admin.app.Logger.Error("tokens template error", err.Error())
+	}
+}
+
+func (admin *AdminModule) tokenList(writer http.ResponseWriter, request *http.Request) {
+	tokens, err := admin.dao.GetTokens(requestUser(request).Id)
+	if err != nil {
+		writeResult(writer, 1, err.Error())
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "msg": "", "count": len(tokens), "data": tokens})
+	_, _ = writer.Write(data)
+}
+
+// tokenCreate 生成令牌，令牌只在这里返回一次
+func (admin *AdminModule) tokenCreate(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSpace(request.FormValue("name"))
+	if name == "" || len([]rune(name)) > 50 {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"名称不能为空且不能超过50个字"}`))
+		return
+	}
+	value, err := newTokenValue()
+	if err != nil {
+		writeResult(writer, 2, err.Error())
+		return
+	}
+	token := &ApiToken{UserId: requestUser(request).Id, Name: name, CreatedTime: time.Now().Unix()}
+	if err = admin.dao.AddToken(token, hashToken(value)); err != nil {
+		writeResult(writer, 3, err.Error())
+		return
+	}
+	admin.audit(request, AuditTokenCreate, "", nil, token)
+	data, _ := json.Marshal(map[string]interface{}{"code": 0, "msg": "", "token": value})
+	_, _ = writer.Write(data)
+}
+
+func (admin *AdminModule) tokenDelete(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(request.FormValue("id"))
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"参数错误"}`))
+		return
+	}
+	n, err := admin.dao.DeleteToken(id, requestUser(request).Id)
+	if err != nil {
+		writeResult(writer, 2, err.Error())
+		return
+	}
+	if n == 0 {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"令牌不存在"}`))
+		return
+	}
+	admin.audit(request, AuditTokenDelete, "", map[string]int{"id": id}, nil)
+	_, _ = writer.Write([]byte(`{"code":0}`))
+}
@@ -3,43 +3,184 @@ package pkg
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gookit/slog"
 	"github.com/liuzl/gocc"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/netutil"
 )
 
 type AppConfig struct {
-	Port          string              `json:"port"`
-	AdminPort     string              `json:"admin_port"`
-	CachePath     string              `json:"cache_path"`
-	Spider        []string            `json:"spider"`
-	GoodSpider    []string            `json:"good_spider"`
-	AdminUri      string              `json:"admin_uri"`
-	UserAgent     string              `json:"user_agent"`
-	GlobalReplace []map[string]string `json:"global_replace"`
-	InjectJsPath  string              `json:"inject_js_path"`
-	Keywords      []string
-	InjectJs      string
-	FriendLinks   map[string][]string
-	AdDomains     map[string]bool
+	Port               string              `json:"port"`
+	AdminPort          string              `json:"admin_port"`
+	CachePath          string              `json:"cache_path"`
+	Spider             []string            `json:"spider"`
+	GoodSpider         []string            `json:"good_spider"`
+	AdminUri           string              `json:"admin_uri"`
+	UserAgent          string              `json:"user_agent"`
+	GlobalReplace      []map[string]string `json:"global_replace"`
+	InjectJsPath       string              `json:"inject_js_path"`
+	MaxCacheSize       int64               `json:"max_cache_size"`       //单个缓存最大MB，0不限制
+	CacheStore         string              `json:"cache_store"`          //file、memory、sqlite
+	CacheMemorySize    int64               `json:"cache_memory_size"`    //内存缓存最大MB
+	CacheMaxTotal      int64               `json:"cache_max_total"`      //缓存总容量MB，0不限制
+	CacheMaxDomain     int64               `json:"cache_max_domain"`     //单个站点缓存容量MB，0不限制
+	CacheCleanInterval int64               `json:"cache_clean_interval"` //清理间隔分钟，默认10
+	CacheExpiredKeep   int64               `json:"cache_expired_keep"`   //过期后保留分钟数，供源站出错时使用
+	HtmlCacheSize      int64               `json:"html_cache_size"`      //替换后html的内存缓存MB，0不缓存
+	TlsPort            string              `json:"tls_port"`             //HTTPS端口，为空时不开启
+	TlsCertDir         string              `json:"tls_cert_dir"`         //证书目录，默认 config/certs
+	TlsReloadInterval  int64               `json:"tls_reload_interval"`  //检查证书更新的间隔秒数，默认30
+	AcmeEnable         bool                `json:"acme_enable"`          //证书目录里没有证书时自动申请
+	AcmeEmail          string              `json:"acme_email"`
+	AcmeDirectory      string              `json:"acme_directory"` //ACME服务地址，默认 Let's Encrypt
+	AcmeCaFile         string              `json:"acme_ca_file"`   //ACME服务的根证书，测试服务使用
+	AcmeCacheDir       string              `json:"acme_cache_dir"` //申请到的证书保存目录，默认 config/acme
+	Http2              bool                `json:"http2"`          //HTTPS端口开启HTTP/2
+	H2c                bool                `json:"h2c"`            //HTTP端口接受明文HTTP/2，前面的负载均衡使用h2c时开启
+	AdminH2c           bool                `json:"admin_h2c"`      //后台端口接受明文HTTP/2
+	UpstreamHttp2      bool                `json:"upstream_http2"` //https源站支持时使用HTTP/2，重新加载时所有站点重建回源连接
+	//连接源站的超时秒数，默认10
+	UpstreamConnectTimeout int64 `json:"upstream_connect_timeout"`
+	Keywords               []string
+	InjectJs               string
+	FriendLinks            map[string][]string
+	AdDomains              map[string]bool
+	//SetConfig 时分配，替换后html缓存用来判断配置是否变化
+	generation uint64
 }
+
+// Validate 校验配置，避免错误配置影响正在运行的程序
+func (appConfig *AppConfig) Validate() error {
+	if _, err := strconv.Atoi(appConfig.Port); err != nil {
+		return errors.New("port 配置错误")
+	}
+	if _, err := strconv.Atoi(appConfig.AdminPort); err != nil {
+		return errors.New("admin_port 配置错误")
+	}
+	if strings.TrimSpace(appConfig.CachePath) == "" {
+		return errors.New("cache_path 不能为空")
+	}
+	if !strings.HasPrefix(appConfig.AdminUri, "/") || appConfig.AdminUri == "/" {
+		return errors.New("admin_uri 必须以/开头且不能为/")
+	}
+	if appConfig.CacheStore != "" && appConfig.CacheStore != "file" && appConfig.CacheStore != "memory" && appConfig.CacheStore != "sqlite" {
+		return errors.New("cache_store 只能是 file、memory、sqlite")
+	}
+	if appConfig.CacheStore == "memory" && appConfig.CacheMemorySize <= 0 {
+		return errors.New("cache_store 为 memory 时 cache_memory_size 必须大于0")
+	}
+	if appConfig.MaxCacheSize < 0 {
+		return errors.New("max_cache_size 不能小于0")
+	}
+	if appConfig.HtmlCacheSize < 0 {
+		return errors.New("html_cache_size 不能小于0")
+	}
+	if appConfig.CacheMaxTotal < 0 || appConfig.CacheMaxDomain < 0 || appConfig.CacheCleanInterval < 0 || appConfig.CacheExpiredKeep < 0 {
+		return errors.New("缓存清理配置不能小于0")
+	}
+	if appConfig.TlsPort != "" {
+		if _, err := strconv.Atoi(appConfig.TlsPort); err != nil || appConfig.TlsPort == appConfig.Port || appConfig.TlsPort == appConfig.AdminPort {
+			return errors.New("tls_port 配置错误")
+		}
+	}
+	if appConfig.UpstreamConnectTimeout < 0 {
+		return errors.New("upstream_connect_timeout 不能小于0")
+	}
+	if appConfig.TlsReloadInterval < 0 {
+		return errors.New("tls_reload_interval 不能小于0")
+	}
+	if appConfig.AcmeEnable && appConfig.TlsPort == "" {
+		return errors.New("acme_enable 需要配置 tls_port")
+	}
+	if !strings.HasPrefix(appConfig.InjectJsPath, "/") {
+		return errors.New("inject_js_path 必须以/开头")
+	}
+	for _, spider := range appConfig.Spider {
+		if strings.TrimSpace(spider) == "" {
+			return errors.New("spider 不能包含空字符串")
+		}
+	}
+	for _, spider := range appConfig.GoodSpider {
+		if strings.TrimSpace(spider) == "" {
+			return errors.New("good_spider 不能包含空字符串")
+		}
+	}
+	for _, item := range appConfig.GlobalReplace {
+		if item["needle"] == "" {
+			return errors.New("global_replace 的 needle 不能为空")
+		}
+	}
+	return nil
+}
+
 type Application struct {
-	*AppConfig
-	Dao *Dao
+	config atomic.Value
+	cache  atomic.Value
+	html   atomic.Value
+	Dao    *Dao
 	*http.Server
 	AdminServer *http.Server
+	TlsServer   *http.Server
 	Sites       sync.Map
 	S2T         *gocc.OpenCC
 	IpList      []net.IP
 	ExpireDate  string
 	Logger      *slog.Logger
+	records     chan *AccessRecord
+	recordDone  chan struct{}
+	recordLock  sync.RWMutex
+	janitorStop chan struct{}
+	janitorDone chan struct{}
+	certs       *certStore
+	acme        *autocert.Manager
+	certStop    chan struct{}
+	certDone    chan struct{}
+	metrics     sync.Map //域名 -> *siteMetrics
+	healthStop  chan struct{}
+	healthDone  chan struct{}
+	//后台和 SIGHUP 可能同时重新加载，后台保存基础配置也要加锁
+	reloadLock sync.Mutex
+}
+
+// Config 返回当前生效的配置，重新加载时会整体替换，不要修改返回值
+func (app *Application) Config() *AppConfig {
+	config, _ := app.config.Load().(*AppConfig)
+	return config
+}
+
+func (app *Application) SetConfig(appConfig *AppConfig) {
+	appConfig.generation = nextGeneration()
+	app.config.Store(appConfig)
+}
+
+func (app *Application) CacheStore() CacheStore {
+	store, _ := app.cache.Load().(CacheStore)
+	return store
+}
+
+func (app *Application) SetCacheStore(store CacheStore) {
+	app.cache.Store(store)
+}
+
+func (app *Application) HtmlCache() *HtmlCache {
+	htmlCache, _ := app.html.Load().(*HtmlCache)
+	return htmlCache
+}
+
+func (app *Application) SetHtmlCache(htmlCache *HtmlCache) {
+	app.html.Store(htmlCache)
 }
 
 func (app *Application) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -48,9 +189,10 @@ func (app *Application) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 		_, _ = writer.Write([]byte(authErr.Error()))
 		return
 	}
-	if request.URL.Path == app.InjectJsPath {
+	appConfig := app.Config()
+	if request.URL.Path == appConfig.InjectJsPath {
 		writer.Header().Set("Content-Type", "text/javascript;charset=utf-8")
-		writer.Write([]byte(app.InjectJs))
+		writer.Write([]byte(appConfig.InjectJs))
 		return
 	}
 	host := GetHost(request)
@@ -61,20 +203,65 @@ func (app *Application) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 	}
 	if site.Scheme == "" {
 		site.Scheme = request.Header.Get("scheme")
+		if site.Scheme == "" && request.TLS != nil {
+			site.Scheme = "https"
+		}
+	}
+	start := time.Now()
+	ua := request.UserAgent()
+	record := &AccessRecord{
+		Domain:      host,
+		Path:        request.URL.RequestURI(),
+		Spider:      site.crawlerName(ua),
+		UserAgent:   ua,
+		CreatedTime: start.Unix(),
 	}
-	site.Route(writer, request)
+	atomic.AddInt64(&site.requests, 1)
+	defer atomic.AddInt64(&site.requests, -1)
+	rw := &recordWriter{ResponseWriter: writer, status: http.StatusOK}
+	site.Route(rw, request.WithContext(context.WithValue(request.Context(), ACCESS_RECORD, record)))
+	record.Status = rw.status
+	record.Latency = time.Since(start).Milliseconds()
+	if site.metrics != nil {
+		site.metrics.addRequest(rw.status, rw.written)
+	}
+	app.addRecord(record)
 }
 
 func (app *Application) Start() {
-	l, err := net.Listen("tcp", ":"+app.Port)
+	appConfig := app.Config()
+	l, err := net.Listen("tcp", ":"+appConfig.Port)
 	if err != nil {
 		app.Logger.Fatalln("net listen", err.Error())
 		return
 	}
 	l = netutil.LimitListener(l, 256*2048)
-	app.Server = &http.Server{Handler: app}
+	app.records = make(chan *AccessRecord, 4096)
+	app.recordDone = make(chan struct{})
+	go app.recordLoop()
+	app.startJanitor()
+	app.startHealthCheck()
+	var handler http.Handler = app
+	if appConfig.TlsPort != "" {
+		if err = app.startTls(appConfig); err != nil {
+			app.Logger.Fatalln("tls listen", err.Error())
+			return
+		}
+		if app.acme != nil {
+			//http-01 验证请求
+			handler = app.acme.HTTPHandler(app)
+		}
+	}
+	if appConfig.H2c {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	app.Server = &http.Server{Handler: handler}
 	admin := NewAdmin(app)
-	app.AdminServer = &http.Server{Handler: admin.adminMux, Addr: ":" + app.AdminPort}
+	var adminHandler http.Handler = admin.adminMux
+	if appConfig.AdminH2c {
+		adminHandler = h2c.NewHandler(adminHandler, &http2.Server{})
+	}
+	app.AdminServer = &http.Server{Handler: adminHandler, Addr: ":" + appConfig.AdminPort}
 	go func() {
 		if err := app.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			app.Logger.Fatalln("监听错误" + err.Error())
@@ -99,6 +286,15 @@ func (app *Application) Stop() {
 	if err != nil {
 		app.Logger.Error("shutdown error" + err.Error())
 	}
+	if app.TlsServer != nil {
+		if err = app.TlsServer.Shutdown(ctx); err != nil {
+			app.Logger.Error("shutdown error" + err.Error())
+		}
+		app.stopCertWatcher()
+	}
+	app.stopRecord()
+	app.stopJanitor()
+	app.stopHealthCheck()
 	defer cancel()
 }
 
@@ -114,6 +310,118 @@ func (app *Application) MakeSite(siteConfig *SiteConfig) error {
 
 }
 
+// Reload 重新读取配置文件和站点配置，校验失败时保留原配置
+func (app *Application) Reload() error {
+	app.reloadLock.Lock()
+	defer app.reloadLock.Unlock()
+	appConfig, err := ParseAppConfig()
+	if err != nil {
+		return err
+	}
+	if err = appConfig.Validate(); err != nil {
+		return err
+	}
+	oldConfig := app.Config()
+	if oldConfig != nil {
+		//端口和后台路径在启动时绑定，修改后需要重启
+		if appConfig.Port != oldConfig.Port || appConfig.AdminPort != oldConfig.AdminPort || appConfig.AdminUri != oldConfig.AdminUri {
+			app.Logger.Warn("port、admin_port、admin_uri 修改需要重启才能生效")
+		}
+		if appConfig.TlsPort != oldConfig.TlsPort || appConfig.AcmeEnable != oldConfig.AcmeEnable || appConfig.AcmeDirectory != oldConfig.AcmeDirectory ||
+			appConfig.AcmeEmail != oldConfig.AcmeEmail || appConfig.AcmeCaFile != oldConfig.AcmeCaFile || appConfig.AcmeCacheDir != oldConfig.AcmeCacheDir {
+			app.Logger.Warn("tls_port 和 acme 配置修改需要重启才能生效")
+		}
+		if appConfig.Http2 != oldConfig.Http2 || appConfig.H2c != oldConfig.H2c || appConfig.AdminH2c != oldConfig.AdminH2c {
+			app.Logger.Warn("http2、h2c、admin_h2c 修改需要重启才能生效")
+		}
+		appConfig.Port = oldConfig.Port
+		appConfig.TlsPort = oldConfig.TlsPort
+		appConfig.Http2 = oldConfig.Http2
+		appConfig.H2c = oldConfig.H2c
+		appConfig.AdminH2c = oldConfig.AdminH2c
+		appConfig.AdminPort = oldConfig.AdminPort
+		appConfig.AdminUri = oldConfig.AdminUri
+	}
+	siteConfigs, err := app.Dao.GetAll()
+	if err != nil {
+		return err
+	}
+	//缓存配置修改时新站点使用新缓存，站点都创建成功后再替换
+	oldStore := app.CacheStore()
+	store := oldStore
+	if oldConfig == nil || appConfig.CacheStore != oldConfig.CacheStore || appConfig.CachePath != oldConfig.CachePath || appConfig.CacheMemorySize != oldConfig.CacheMemorySize {
+		if store, err = NewCacheStore(&appConfig); err != nil {
+			return err
+		}
+	}
+	sites := make(map[string]*Site, len(siteConfigs))
+	for _, siteConfig := range siteConfigs {
+		site, err := newSite(siteConfig, app, &appConfig)
+		if err != nil {
+			if store != oldStore {
+				_ = store.Close()
+			}
+			return fmt.Errorf("站点%s配置错误: %w", siteConfig.Domain, err)
+		}
+		site.cache = store
+		sites[siteConfig.Domain] = site
+	}
+	if oldConfig == nil || appConfig.HtmlCacheSize != oldConfig.HtmlCacheSize {
+		app.SetHtmlCache(NewHtmlCache(appConfig.HtmlCacheSize * 1024 * 1024))
+	}
+	replaced := store != oldStore && oldStore != nil
+	//正在运行的清理使用的是旧缓存，先停止，替换后重新启动
+	restartJanitor := replaced && app.janitorStop != nil
+	if restartJanitor {
+		app.stopJanitor()
+	}
+	app.SetCacheStore(store)
+	app.SetConfig(&appConfig)
+	if app.certs != nil {
+		app.loadCerts()
+	}
+	oldSites := make([]*Site, 0)
+	app.Sites.Range(func(key, value any) bool {
+		oldSites = append(oldSites, value.(*Site))
+		return true
+	})
+	for domain, site := range sites {
+		if old, ok := app.Sites.Load(domain); ok && site.Scheme == "" {
+			site.Scheme = old.(*Site).Scheme
+		}
+		app.storeSite(site)
+	}
+	app.Sites.Range(func(key, value any) bool {
+		if _, ok := sites[key.(string)]; !ok {
+			app.deleteSite(key.(string))
+		}
+		return true
+	})
+	if restartJanitor {
+		app.startJanitor()
+	}
+	if replaced {
+		go app.closeCacheStore(oldStore, oldSites)
+	}
+	if oldConfig != nil && appConfig.UpstreamHttp2 != oldConfig.UpstreamHttp2 {
+		app.Logger.Info("upstream_http2 已修改，所有站点已使用新的回源连接")
+	}
+	app.Logger.Info("配置重新加载完成", len(sites))
+	return nil
+}
+
+// closeCacheStore 等替换下来的站点正在处理的请求结束后关闭旧缓存
+func (app *Application) closeCacheStore(store CacheStore, sites []*Site) {
+	for _, site := range sites {
+		for atomic.LoadInt64(&site.requests) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if err := store.Close(); err != nil {
+		app.Logger.Error("关闭旧缓存错误", err.Error())
+	}
+}
+
 func (app *Application) querySite(host string) (*Site, error) {
 	hostParts := strings.Split(host, ".")
 	if len(hostParts) == 1 {
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloseCacheStoreWaitsForRequests(t *testing.T) {
+	app := newTestApp(t)
+	store, err := newSqliteCacheStore(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := &Site{}
+	atomic.AddInt64(&site.requests, 1)
+	done := make(chan struct{})
+	go func() {
+		app.closeCacheStore(store, []*Site{site})
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if err = store.Put("example.com", "/", &CustomResponse{StatusCode: 200, Body: []byte("x")}); err != nil {
+		t.Fatalf("store closed while a request is running: %v", err)
+	}
+	atomic.AddInt64(&site.requests, -1)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("store not closed after the request finished")
+	}
+	if _, err = store.Get("example.com", "/"); err == nil || err == ErrCacheMiss {
+		t.Fatalf("want an error from the closed store, got %v", err)
+	}
+}
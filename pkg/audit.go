@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuditSiteAdd        = "site_add"
+	AuditSiteUpdate     = "site_update"
+	AuditSiteDelete     = "site_delete"
+	AuditSiteImport     = "site_import"
+	AuditSiteRevert     = "site_revert"
+	AuditForbiddenWords = "forbidden_words"
+	AuditBaseConfig     = "base_config"
+	AuditUserSave       = "user_save"
+	AuditUserDelete     = "user_delete"
+	AuditTokenCreate    = "token_create"
+	AuditTokenDelete    = "token_delete"
+)
+
+// siteAuditActions Before/After 保存的是 SiteConfig 的操作，可以用来恢复站点
+var siteAuditActions = map[string]bool{
+	AuditSiteAdd:        true,
+	AuditSiteUpdate:     true,
+	AuditSiteDelete:     true,
+	AuditSiteImport:     true,
+	AuditSiteRevert:     true,
+	AuditForbiddenWords: true,
+}
+
+// AuditLog 后台操作记录，Before/After 为修改前后的JSON
+type AuditLog struct {
+	Id          int64  `json:"id"`
+	UserName    string `json:"user_name"`
+	Action      string `json:"action"`
+	Domain      string `json:"domain"`
+	Before      string `json:"before"`
+	After       string `json:"after"`
+	Ip          string `json:"ip"`
+	CreatedTime int64  `json:"created_time"`
+}
+
+func clientIP(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return ip
+}
+
+// auditJson nil 指针也保存为空，恢复时空配置表示站点不存在
+func auditJson(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// audit 记录操作，写入失败只记日志
+func (admin *AdminModule) audit(request *http.Request, action, domain string, before, after interface{}) {
+	log := &AuditLog{
+		Action:      action,
+		Domain:      domain,
+		Before:      auditJson(before),
+		After:       auditJson(after),
+		Ip:          clientIP(request),
+		CreatedTime: time.Now().Unix(),
+	}
+	if account := requestUser(request); account != nil {
+		log.UserName = account.UserName
+	}
+	if err := admin.dao.AddAudit(log); err != nil {
+		admin.app.Logger.Error("add audit error", action, domain, err.Error())
+	}
+}
+
+// siteSnapshot 读取数据库中的站点配置，不存在返回nil
+func (admin *AdminModule) siteSnapshot(domain string) *SiteConfig {
+	siteConfig, err := admin.dao.GetOne(domain)
+	if err != nil {
+		return nil
+	}
+	return &siteConfig
+}
+
+func (admin *AdminModule) auditPage(w http.ResponseWriter, request *http.Request) {
+	t, err := template.ParseFiles("admin/audit.html")
+	if err != nil {
+		admin.app.Logger.Error("audit template error", err.Error())
+		return
+	}
+	err = t.Execute(w, map[string]string{"admin_uri": admin.prefix})
+	if err != nil {
+		admin.app.Logger.Error("audit template error", err.Error())
+	}
+}
+
+func (admin *AdminModule) auditList(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	var result = make(map[string]interface{})
+	p, err := strconv.Atoi(v.Get("page"))
+	if err != nil || p <= 0 {
+		p = 1
+	}
+	size, err := strconv.Atoi(v.Get("limit"))
+	if err != nil || size <= 0 {
+		size = 50
+	}
+	domain := strings.TrimSpace(v.Get("domain"))
+	action := strings.TrimSpace(v.Get("action"))
+	logs, err := admin.dao.GetAuditByPage(p, size, domain, action)
+	if err != nil {
+		result["code"] = 2
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	count, err := admin.dao.CountAudit(domain, action)
+	if err != nil {
+		result["code"] = 3
+		result["msg"] = err.Error()
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	result["code"] = 0
+	result["msg"] = ""
+	result["count"] = count
+	result["data"] = logs
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
+
+// auditRevert 把站点恢复到某条记录修改前(version=before)或修改后(version=after)的配置，
+// 对应的配置为空时删除站点
+func (admin *AdminModule) auditRevert(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(request.FormValue("id"), 10, 64)
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"参数错误"}`))
+		return
+	}
+	log, err := admin.dao.GetAudit(id)
+	if err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"记录不存在"}`))
+		return
+	}
+	if log.Domain == "" || !siteAuditActions[log.Action] {
+		_, _ = writer.Write([]byte(`{"code":2,"msg":"这条记录不能恢复"}`))
+		return
+	}
+	if !admin.checkDomains(writer, request, log.Domain) {
+		return
+	}
+	version := log.Before
+	if request.FormValue("version") == "after" {
+		version = log.After
+	}
+	var target *SiteConfig
+	if version != "" {
+		target = &SiteConfig{}
+		if err = json.Unmarshal([]byte(version), target); err != nil || target.Domain != log.Domain {
+			_, _ = writer.Write([]byte(`{"code":3,"msg":"记录内容错误"}`))
+			return
+		}
+		//替换规则改版前的记录只有 finds、replaces
+		if target.Rules == nil {
+			var legacy struct {
+				Finds    []string `json:"finds"`
+				Replaces []string `json:"replaces"`
+			}
+			_ = json.Unmarshal([]byte(version), &legacy)
+			target.Rules = legacyRules(legacy.Finds, legacy.Replaces)
+		}
+	}
+	current := admin.siteSnapshot(log.Domain)
+	//记录里的回源密码和令牌是隐藏的，只能沿用当前的值，站点已删除时无法恢复
+	if target != nil {
+		var upstream *UpstreamConfig
+		if current != nil {
+			upstream = &current.Upstream
+		}
+		if err = target.Upstream.keepSecrets(upstream); err != nil {
+			writeResult(writer, 4, err.Error())
+			return
+		}
+	}
+	switch {
+	case target == nil && current != nil:
+		err = admin.dao.DeleteOne(current.Id)
+		if err == nil {
+			admin.app.deleteSite(log.Domain)
+		}
+	case target != nil && current != nil:
+		target.Id = current.Id
+		err = admin.dao.UpdateById(*target)
+	case target != nil:
+		err = admin.dao.addOne(*target)
+	}
+	if err != nil {
+		data, _ := json.Marshal(map[string]interface{}{"code": 4, "msg": err.Error()})
+		_, _ = writer.Write(data)
+		return
+	}
+	after := admin.siteSnapshot(log.Domain)
+	if target != nil {
+		siteConfig := *target
+		if err = admin.app.MakeSite(&siteConfig); err != nil {
+			admin.app.Logger.Error("revert make site error", log.Domain, err.Error())
+		}
+	}
+	admin.deleteCache(log.Domain)
+	admin.audit(request, AuditSiteRevert, log.Domain, current, after)
+	_, _ = writer.Write([]byte(`{"code":0,"msg":"恢复成功"}`))
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// originPool 站点的所有源站，第一个是镜像链接，按 balance 选择每次请求使用的源站
+type originPool struct {
+	balance string
+	origins []*originState
+	next    uint32
+}
+
+// newOriginPool 解析镜像链接和 upstream.origins，返回的地址用来替换页面里的源站域名
+func newOriginPool(siteConfig *SiteConfig) (*originPool, []*url.URL, error) {
+	urls := make([]*url.URL, 0, len(siteConfig.Upstream.Origins)+1)
+	for _, origin := range append([]string{siteConfig.Url}, siteConfig.Upstream.Origins...) {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, nil, err
+		}
+		urls = append(urls, u)
+	}
+	pool := &originPool{balance: siteConfig.Upstream.Balance, origins: make([]*originState, 0, len(urls))}
+	for _, u := range urls {
+		pool.origins = append(pool.origins, newOriginState(u, &siteConfig.Upstream))
+	}
+	return pool, urls, nil
+}
+
+// inherit 源站地址和回源设置都没有变化时沿用 old 里的熔断、健康检查和耗时，保存站点不会让熔断中的源站恢复
+func (pool *originPool) inherit(old *originPool, oldUpstream, upstream *UpstreamConfig) {
+	if !sameOriginSettings(oldUpstream, upstream) {
+		return
+	}
+	for i, origin := range pool.origins {
+		for _, oldOrigin := range old.origins {
+			if oldOrigin.url.String() == origin.url.String() {
+				pool.origins[i] = oldOrigin
+				break
+			}
+		}
+	}
+}
+
+// sameOriginSettings 比较除源站列表和选择方式以外的回源设置，增减备用源站不影响其他源站的状态
+func sameOriginSettings(a, b *UpstreamConfig) bool {
+	x, y := *a, *b
+	x.Origins, x.Balance = nil, ""
+	y.Origins, y.Balance = nil, ""
+	return encodeUpstream(x) == encodeUpstream(y)
+}
+
+// originAttempt 一次请求已经使用过的源站，源站失败时换下一个源站重试
+type originAttempt struct {
+	//Site.ServeHTTP 收到的请求，重试时从这里重新请求，ErrorHandler 拿到的是 Director 修改过的请求
+	request *http.Request
+	writer  *originWriter
+	tried   []*originState
+	current *originState
+	//当前源站连接失败、返回5xx或者熔断
+	failed bool
+}
+
+func (attempt *originAttempt) hasTried(origin *originState) bool {
+	for _, item := range attempt.tried {
+		if item == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// pick 在这次请求还没用过的源站里选择，都熔断时返回没用过的第一个，由 originTransport 拒绝
+func (pool *originPool) pick(attempt *originAttempt) *originState {
+	candidates := make([]*originState, 0, len(pool.origins))
+	var fallback *originState
+	for _, origin := range pool.origins {
+		if attempt.hasTried(origin) {
+			continue
+		}
+		if fallback == nil {
+			fallback = origin
+		}
+		if origin.available() {
+			candidates = append(candidates, origin)
+		}
+	}
+	if len(candidates) == 0 {
+		if fallback == nil {
+			return pool.origins[0]
+		}
+		return fallback
+	}
+	switch pool.balance {
+	case BalanceRoundRobin:
+		return candidates[int((atomic.AddUint32(&pool.next, 1)-1)%uint32(len(candidates)))]
+	case BalanceLeastLatency:
+		//还没有耗时的源站为0，会先被选中一次
+		best, bestLatency := candidates[0], candidates[0].averageLatency()
+		for _, origin := range candidates[1:] {
+			if latency := origin.averageLatency(); latency < bestLatency {
+				best, bestLatency = origin, latency
+			}
+		}
+		return best
+	}
+	return candidates[0]
+}
+
+// canRetry 还有没用过的源站并且还没有输出响应时可以重试，只重试 GET、HEAD，请求体已经发给了上一个源站
+func (pool *originPool) canRetry(attempt *originAttempt, request *http.Request) bool {
+	return attempt != nil && attempt.request != nil && !attempt.writer.wroteHeader && len(attempt.tried) < len(pool.origins) &&
+		(request.Method == http.MethodGet || request.Method == http.MethodHead) && request.Context().Err() == nil
+}
+
+// originWriter 记录是否已经输出了响应头，输出后不能再换源站
+type originWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *originWriter) WriteHeader(statusCode int) {
+	//1xx 之后还会有正式的响应
+	if statusCode >= 200 {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *originWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *originWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		flusher.Flush()
+	}
+}
+
+func (w *originWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ServeHTTP 每次请求记录使用过的源站，再交给 ReverseProxy
+func (site *Site) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	attempt := &originAttempt{writer: &originWriter{ResponseWriter: writer}}
+	attempt.request = request.WithContext(context.WithValue(request.Context(), ORIGIN_ATTEMPT, attempt))
+	site.ReverseProxy.ServeHTTP(attempt.writer, attempt.request)
+}
+
+// originTarget 给 newProxy 选择这次请求的源站
+func (site *Site) originTarget(req *http.Request) *url.URL {
+	attempt, _ := req.Context().Value(ORIGIN_ATTEMPT).(*originAttempt)
+	if attempt == nil {
+		attempt = &originAttempt{}
+	}
+	attempt.current = site.pool.pick(attempt)
+	attempt.tried = append(attempt.tried, attempt.current)
+	attempt.failed = false
+	return attempt.current.url
+}
+
+// retryOrigin 当前源站失败时换下一个源站重新请求，返回false时交给 ErrorHandler
+func (site *Site) retryOrigin(writer http.ResponseWriter, request *http.Request, e error) bool {
+	attempt, _ := request.Context().Value(ORIGIN_ATTEMPT).(*originAttempt)
+	if attempt == nil || !attempt.failed || !site.pool.canRetry(attempt, request) {
+		return false
+	}
+	if !errors.Is(e, errBreakerOpen) {
+		site.app.Logger.Warn("源站失败，换下一个源站", attempt.current.url.String(), request.URL.String(), e.Error())
+	}
+	site.metrics.addOriginError()
+	site.ReverseProxy.ServeHTTP(attempt.writer, attempt.request)
+	return true
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFailoverUsesInboundRequest(t *testing.T) {
+	var primaryHits int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryHits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	type seen struct {
+		path, query, forwarded, referer string
+		tokens                          []string
+	}
+	backupRequests := make(chan seen, 4)
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backupRequests <- seen{r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Forwarded-For"), r.Header.Get("Referer"), r.Header.Values("X-Token")}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte("backup"))
+	}))
+	defer backup.Close()
+
+	app := newTestApp(t)
+	newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: primary.URL + "/base?z=1", Upstream: UpstreamConfig{
+		Origins: []string{backup.URL + "/sub?k=v"},
+		Headers: map[string]string{"X-Token": "abc"},
+	}})
+
+	recorder := serveTest(app, http.MethodGet, "http://example.com/p?x=1")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "backup" {
+		t.Fatalf("got %d %q, want the backup response", recorder.Code, recorder.Body.String())
+	}
+	if atomic.LoadInt32(&primaryHits) != 1 {
+		t.Fatalf("primary hits = %d, want 1", primaryHits)
+	}
+	got := <-backupRequests
+	if got.path != "/sub/p" || got.query != "k=v&x=1" {
+		t.Errorf("backup got %s?%s, want /sub/p?k=v&x=1", got.path, got.query)
+	}
+	if got.forwarded != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For = %q, want a single client IP", got.forwarded)
+	}
+	if got.referer != backup.URL {
+		t.Errorf("Referer = %q, want the backup origin", got.referer)
+	}
+	if len(got.tokens) != 1 || got.tokens[0] != "abc" {
+		t.Errorf("X-Token = %v, want [abc]", got.tokens)
+	}
+}
+
+func TestFailoverSkipsPost(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	var backupHits int32
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backupHits, 1)
+	}))
+	defer backup.Close()
+
+	app := newTestApp(t)
+	newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: primary.URL, Upstream: UpstreamConfig{Origins: []string{backup.URL}}})
+	if recorder := serveTest(app, http.MethodPost, "http://example.com/form"); recorder.Code != http.StatusBadGateway {
+		t.Fatalf("got %d, want the primary 502", recorder.Code)
+	}
+	if backupHits != 0 {
+		t.Fatalf("backup hits = %d, want 0", backupHits)
+	}
+}
+
+func TestCanRetryAfterWrite(t *testing.T) {
+	pool := &originPool{origins: []*originState{{}, {}}}
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	attempt := &originAttempt{request: request, writer: &originWriter{ResponseWriter: httptest.NewRecorder()}, tried: pool.origins[:1]}
+	if !pool.canRetry(attempt, request) {
+		t.Fatal("want retry before anything is written")
+	}
+	attempt.writer.WriteHeader(http.StatusOK)
+	if pool.canRetry(attempt, request) {
+		t.Fatal("want no retry after the response header is written")
+	}
+}
+
+func TestOriginPoolPick(t *testing.T) {
+	a, b := &originState{state: BreakerClosed}, &originState{state: BreakerClosed}
+	pool := &originPool{balance: BalanceFailover, origins: []*originState{a, b}}
+	if got := pool.pick(&originAttempt{}); got != a {
+		t.Fatal("failover should use the first origin")
+	}
+	if got := pool.pick(&originAttempt{tried: []*originState{a}}); got != b {
+		t.Fatal("failover should skip tried origins")
+	}
+
+	pool.balance = BalanceRoundRobin
+	first, second := pool.pick(&originAttempt{}), pool.pick(&originAttempt{})
+	if first == second {
+		t.Fatal("round robin should alternate")
+	}
+
+	pool.balance = BalanceLeastLatency
+	a.latency, b.latency = 50, 10
+	if got := pool.pick(&originAttempt{}); got != b {
+		t.Fatal("least latency should use the faster origin")
+	}
+}
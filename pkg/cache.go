@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCacheMiss     = errors.New("缓存不存在")
+	errCacheTooLarge = errors.New("超过最大缓存大小")
+)
+
+// CacheStore 缓存存储，key 为站点域名加请求路径
+type CacheStore interface {
+	Get(domain, key string) (*CacheEntry, error)
+	Put(domain, key string, resp *CustomResponse) error
+	// Writer 用于边下载边写入，limit 为最大字节数，0 不限制
+	Writer(domain, key string, resp *CustomResponse, limit int64) (CacheWriter, error)
+	// Touch 更新缓存时间，源站返回304时使用
+	Touch(domain, key string) error
+	Delete(domain, key string) error
+	DeleteDomain(domain string) error
+	Stats() (CacheStats, error)
+	// Items 列出所有缓存，用于清理过期和超出容量的缓存
+	Items() ([]CacheItem, error)
+	Remove(items []CacheItem) error
+	// Close 重新加载配置换了缓存后关闭旧缓存
+	Close() error
+}
+
+// CacheItem 缓存条目信息，Id 为存储内部标识
+type CacheItem struct {
+	Domain     string
+	Id         string
+	Size       int64
+	ModTime    time.Time
+	AccessTime time.Time
+}
+
+// CacheWriter 写完调用Commit才会生效，出错或中断调用Abort丢弃
+type CacheWriter interface {
+	io.Writer
+	Commit() error
+	Abort()
+}
+
+type CacheEntry struct {
+	Response *CustomResponse
+	Body     CacheBody
+	ModTime  time.Time
+}
+
+type CacheStats struct {
+	Type    string           `json:"type"`
+	Entries int64            `json:"entries"`
+	Bytes   int64            `json:"bytes"`
+	Domains map[string]int64 `json:"domains"`
+}
+
+// NewCacheStore 根据配置创建缓存存储，cache_store 可选 file、memory、sqlite
+func NewCacheStore(appConfig *AppConfig) (CacheStore, error) {
+	switch appConfig.CacheStore {
+	case "", "file":
+		return newFileCacheStore(appConfig.CachePath), nil
+	case "memory":
+		return newMemoryCacheStore(appConfig.CacheMemorySize * 1024 * 1024), nil
+	case "sqlite":
+		return newSqliteCacheStore(path.Join(appConfig.CachePath, "cache.db"))
+	}
+	return nil, errors.New("cache_store 配置错误: " + appConfig.CacheStore)
+}
+
+// CacheBody 缓存的响应体，支持Seek以便处理Range请求
+type CacheBody interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64
+}
+
+type bytesCacheBody struct {
+	*bytes.Reader
+}
+
+func (b *bytesCacheBody) Close() error {
+	return nil
+}
+
+// bufferCacheWriter 先写入内存，Commit时一次性保存，用于不支持流式写入的存储
+type bufferCacheWriter struct {
+	buf    bytes.Buffer
+	limit  int64
+	commit func(body []byte) error
+}
+
+func (w *bufferCacheWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && int64(w.buf.Len()+len(p)) > w.limit {
+		return 0, errCacheTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+func (w *bufferCacheWriter) Commit() error {
+	return w.commit(w.buf.Bytes())
+}
+
+func (w *bufferCacheWriter) Abort() {
+	w.buf.Reset()
+}
+
+// normalizeCacheHeader 缓存的内容都是解压并转成utf-8之后的
+func normalizeCacheHeader(header http.Header) {
+	contentType := header.Get("Content-Type")
+	if strings.Contains(strings.ToLower(contentType), "charset") {
+		contentPartArr := strings.Split(contentType, ";")
+		header.Set("Content-Type", contentPartArr[0]+"; charset=utf-8")
+	}
+	header.Del("Content-Encoding")
+	header.Del("Content-Security-Policy")
+}
+
+// isTextContent 需要替换内容的类型，其他类型直接流式转发
+func isTextContent(contentType string) bool {
+	return strings.Contains(contentType, "text/html") ||
+		strings.Contains(contentType, "css") ||
+		strings.Contains(contentType, "javascript")
+}
+
+// cacheTeeBody 把源站响应体转发给客户端的同时写入缓存
+type cacheTeeBody struct {
+	io.ReadCloser
+	cache CacheWriter
+	site  *Site
+}
+
+func (b *cacheTeeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.cache != nil {
+		if _, writeErr := b.cache.Write(p[:n]); writeErr != nil {
+			if !errors.Is(writeErr, errCacheTooLarge) {
+				b.site.app.Logger.Error("write cache error", writeErr.Error())
+			}
+			b.cache.Abort()
+			b.cache = nil
+		}
+	}
+	if err != nil && b.cache != nil {
+		if err == io.EOF {
+			if commitErr := b.cache.Commit(); commitErr != nil {
+				b.site.app.Logger.Error("commit cache error", commitErr.Error())
+			}
+		} else {
+			b.cache.Abort()
+		}
+		b.cache = nil
+	}
+	return n, err
+}
+
+func (b *cacheTeeBody) Close() error {
+	//没有读完就关闭，缓存不完整
+	if b.cache != nil {
+		b.cache.Abort()
+		b.cache = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
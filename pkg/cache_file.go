@@ -0,0 +1,289 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 缓存文件格式：magic + 头信息长度 + gob编码的头信息 + 原始响应体
+// 响应体不经过gob编码，大文件可以边下载边写入，读取时也可以直接从文件输出
+const cacheMagic = "MRC1"
+
+// fileCacheStore 缓存保存在 CachePath/domain/xx/sha1
+type fileCacheStore struct {
+	path string
+	//文件系统一般不记录访问时间，这里记录最后访问时间用于LRU淘汰
+	access sync.Map
+}
+
+func newFileCacheStore(cachePath string) *fileCacheStore {
+	return &fileCacheStore{path: cachePath}
+}
+
+type fileCacheBody struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (b *fileCacheBody) Close() error {
+	return b.file.Close()
+}
+
+func (store *fileCacheStore) Get(domain, key string) (*CacheEntry, error) {
+	filename := cacheFilename(store.path, domain, key)
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return nil, ErrCacheMiss
+	}
+	resp, body, err := readCacheFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	store.access.Store(filename, time.Now())
+	return &CacheEntry{Response: resp, Body: body, ModTime: fileInfo.ModTime()}, nil
+}
+
+func (store *fileCacheStore) Put(domain, key string, resp *CustomResponse) error {
+	cacheWriter, err := store.Writer(domain, key, resp, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = cacheWriter.Write(resp.Body); err != nil {
+		cacheWriter.Abort()
+		return err
+	}
+	return cacheWriter.Commit()
+}
+
+func (store *fileCacheStore) Writer(domain, key string, resp *CustomResponse, limit int64) (CacheWriter, error) {
+	return newCacheFileWriter(cacheFilename(store.path, domain, key), resp, limit)
+}
+
+func (store *fileCacheStore) Touch(domain, key string) error {
+	now := time.Now()
+	return os.Chtimes(cacheFilename(store.path, domain, key), now, now)
+}
+
+func (store *fileCacheStore) Delete(domain, key string) error {
+	filename := cacheFilename(store.path, domain, key)
+	store.access.Delete(filename)
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (store *fileCacheStore) DeleteDomain(domain string) error {
+	if domain == "" || strings.Contains(domain, "..") || strings.ContainsAny(domain, "/\\") {
+		return nil
+	}
+	dir := path.Join(store.path, domain)
+	if !isExist(dir) {
+		return nil
+	}
+	store.access.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), dir+"/") {
+			store.access.Delete(key)
+		}
+		return true
+	})
+	return os.RemoveAll(dir)
+}
+
+func (store *fileCacheStore) Items() ([]CacheItem, error) {
+	items := make([]CacheItem, 0)
+	if !isExist(store.path) {
+		return items, nil
+	}
+	err := filepath.Walk(store.path, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		//写入中断残留的临时文件
+		if strings.HasSuffix(filename, ".tmp") {
+			if time.Since(info.ModTime()) > time.Hour {
+				_ = os.Remove(filename)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(store.path, filename)
+		if err != nil {
+			return nil
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		id := path.Join(store.path, filepath.ToSlash(rel))
+		item := CacheItem{Domain: parts[0], Id: id, Size: info.Size(), ModTime: info.ModTime(), AccessTime: info.ModTime()}
+		if accessTime, ok := store.access.Load(id); ok && accessTime.(time.Time).After(item.AccessTime) {
+			item.AccessTime = accessTime.(time.Time)
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func (store *fileCacheStore) Remove(items []CacheItem) error {
+	for _, item := range items {
+		store.access.Delete(item.Id)
+		if err := os.Remove(item.Id); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *fileCacheStore) Close() error {
+	return nil
+}
+
+func (store *fileCacheStore) Stats() (CacheStats, error) {
+	stats := CacheStats{Type: "file", Domains: make(map[string]int64)}
+	if !isExist(store.path) {
+		return stats, nil
+	}
+	err := filepath.Walk(store.path, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() || strings.HasSuffix(filename, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(store.path, filename)
+		if err != nil {
+			return nil
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		stats.Entries++
+		stats.Bytes += info.Size()
+		stats.Domains[parts[0]] += info.Size()
+		return nil
+	})
+	return stats, err
+}
+
+func cacheFilename(cachePath, domain, key string) string {
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+	return path.Join(cachePath, domain, hash[:2], hash)
+}
+
+// cacheFileWriter 先写入临时文件，完整写完后再改名，避免读到不完整的缓存
+type cacheFileWriter struct {
+	file     *os.File
+	filename string
+	size     int64
+	limit    int64
+}
+
+func newCacheFileWriter(filename string, resp *CustomResponse, limit int64) (*cacheFileWriter, error) {
+	dir := path.Dir(filename)
+	if !isExist(dir) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.CreateTemp(dir, path.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	_ = file.Chmod(0644)
+	meta := *resp
+	meta.Body = nil
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(&meta); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	head := make([]byte, len(cacheMagic)+4)
+	copy(head, cacheMagic)
+	binary.BigEndian.PutUint32(head[len(cacheMagic):], uint32(buf.Len()))
+	if _, err = file.Write(append(head, buf.Bytes()...)); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &cacheFileWriter{file: file, filename: filename, limit: limit}, nil
+}
+
+func (w *cacheFileWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.size+int64(len(p)) > w.limit {
+		return 0, errCacheTooLarge
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *cacheFileWriter) Commit() error {
+	tmp := w.file.Name()
+	if err := w.file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, w.filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (w *cacheFileWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// readCacheFile 读取缓存文件，兼容旧的整体gob编码格式
+func readCacheFile(filename string) (*CustomResponse, CacheBody, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	head := make([]byte, len(cacheMagic)+4)
+	if _, err = io.ReadFull(file, head); err != nil || string(head[:len(cacheMagic)]) != cacheMagic {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		resp := new(CustomResponse)
+		err = gob.NewDecoder(file).Decode(resp)
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		body := &bytesCacheBody{bytes.NewReader(resp.Body)}
+		resp.Body = nil
+		return resp, body, nil
+	}
+	metaLength := int64(binary.BigEndian.Uint32(head[len(cacheMagic):]))
+	resp := new(CustomResponse)
+	if err = gob.NewDecoder(io.LimitReader(file, metaLength)).Decode(resp); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	offset := int64(len(head)) + metaLength
+	body := &fileCacheBody{SectionReader: io.NewSectionReader(file, offset, fileInfo.Size()-offset), file: file}
+	return resp, body, nil
+}
@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HtmlCache 缓存替换后的html，按 站点+访问域名+路径 保存，命中时不用再解析html
+// 站点配置修改或全局配置变化后旧的条目不会再命中，由LRU淘汰
+type HtmlCache struct {
+	lock     sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+// htmlCacheItem 只记录站点和配置的编号，不引用旧的站点和配置，淘汰前它们也能被回收
+type htmlCacheItem struct {
+	key     string
+	domain  string
+	site    uint64
+	config  uint64
+	modTime time.Time
+	content []byte
+}
+
+var generations uint64
+
+// nextGeneration 站点和配置每次创建都取一个新编号
+func nextGeneration() uint64 {
+	return atomic.AddUint64(&generations, 1)
+}
+
+func NewHtmlCache(maxBytes int64) *HtmlCache {
+	return &HtmlCache{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func htmlCacheKey(requestHost, cacheKey string) string {
+	return requestHost + "\x00" + cacheKey
+}
+
+// Get modTime 为原始缓存的修改时间，原始缓存更新后替换结果失效
+func (c *HtmlCache) Get(site *Site, key string, modTime time.Time) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*htmlCacheItem)
+	if item.site != site.generation || item.config != site.app.Config().generation || !item.modTime.Equal(modTime) {
+		c.removeElement(element)
+		return nil, false
+	}
+	c.ll.MoveToFront(element)
+	return item.content, true
+}
+
+func (c *HtmlCache) Put(site *Site, key string, modTime time.Time, content []byte) {
+	if c.maxBytes <= 0 || int64(len(content)) > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+	c.items[key] = c.ll.PushFront(&htmlCacheItem{key: key, domain: site.Domain, site: site.generation, config: site.app.Config().generation, modTime: modTime, content: content})
+	c.bytes += int64(len(content))
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *HtmlCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := CacheStats{Type: "html", Entries: int64(c.ll.Len()), Bytes: c.bytes, Domains: make(map[string]int64)}
+	for element := c.ll.Front(); element != nil; element = element.Next() {
+		item := element.Value.(*htmlCacheItem)
+		stats.Domains[item.domain] += int64(len(item.content))
+	}
+	return stats
+}
+
+func (c *HtmlCache) removeElement(element *list.Element) {
+	item := element.Value.(*htmlCacheItem)
+	c.ll.Remove(element)
+	delete(c.items, item.key)
+	c.bytes -= int64(len(item.content))
+}
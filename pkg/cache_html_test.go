@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHtmlCacheGeneration(t *testing.T) {
+	app := newTestApp(t)
+	site := newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: "http://127.0.0.1:1"})
+	htmlCache := NewHtmlCache(1024)
+	modTime := time.Now()
+	key := htmlCacheKey("example.com", "/")
+
+	htmlCache.Put(site, key, modTime, []byte("html"))
+	if content, ok := htmlCache.Get(site, key, modTime); !ok || string(content) != "html" {
+		t.Fatal("want a hit for the same site and config")
+	}
+	if stats := htmlCache.Stats(); stats.Domains["example.com"] != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, ok := htmlCache.Get(site, key, modTime.Add(time.Second)); ok {
+		t.Fatal("changed cache entry should miss")
+	}
+
+	//站点重建后不命中
+	htmlCache.Put(site, key, modTime, []byte("html"))
+	rebuilt := newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: "http://127.0.0.1:1"})
+	if _, ok := htmlCache.Get(rebuilt, key, modTime); ok {
+		t.Fatal("rebuilt site should miss")
+	}
+
+	//全局配置替换后不命中，复制出来的配置也算新配置
+	htmlCache.Put(rebuilt, key, modTime, []byte("html"))
+	appConfig := *app.Config()
+	app.SetConfig(&appConfig)
+	if _, ok := htmlCache.Get(rebuilt, key, modTime); ok {
+		t.Fatal("replaced config should miss")
+	}
+	if stats := htmlCache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("stale entries should be removed: %+v", stats)
+	}
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memoryCacheStore 内存LRU缓存，超过 maxBytes 淘汰最久未访问的
+type memoryCacheStore struct {
+	lock     sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	domain     string
+	key        string
+	resp       CustomResponse
+	body       []byte
+	modTime    time.Time
+	accessTime time.Time
+}
+
+func newMemoryCacheStore(maxBytes int64) *memoryCacheStore {
+	return &memoryCacheStore{maxBytes: maxBytes, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func memoryCacheKey(domain, key string) string {
+	return domain + "\x00" + key
+}
+
+func (store *memoryCacheStore) Get(domain, key string) (*CacheEntry, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	element, ok := store.items[memoryCacheKey(domain, key)]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	store.ll.MoveToFront(element)
+	item := element.Value.(*memoryCacheItem)
+	item.accessTime = time.Now()
+	resp := item.resp
+	resp.Header = item.resp.Header.Clone()
+	return &CacheEntry{Response: &resp, Body: &bytesCacheBody{bytes.NewReader(item.body)}, ModTime: item.modTime}, nil
+}
+
+func (store *memoryCacheStore) Put(domain, key string, resp *CustomResponse) error {
+	meta := *resp
+	meta.Body = nil
+	meta.Header = resp.Header.Clone()
+	now := time.Now()
+	item := &memoryCacheItem{domain: domain, key: key, resp: meta, body: resp.Body, modTime: now, accessTime: now}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if element, ok := store.items[memoryCacheKey(domain, key)]; ok {
+		store.removeElement(element)
+	}
+	if store.maxBytes > 0 && int64(len(item.body)) > store.maxBytes {
+		return errCacheTooLarge
+	}
+	store.items[memoryCacheKey(domain, key)] = store.ll.PushFront(item)
+	store.bytes += int64(len(item.body))
+	for store.maxBytes > 0 && store.bytes > store.maxBytes {
+		store.removeElement(store.ll.Back())
+	}
+	return nil
+}
+
+func (store *memoryCacheStore) Writer(domain, key string, resp *CustomResponse, limit int64) (CacheWriter, error) {
+	if store.maxBytes > 0 && (limit == 0 || limit > store.maxBytes) {
+		limit = store.maxBytes
+	}
+	meta := *resp
+	return &bufferCacheWriter{limit: limit, commit: func(body []byte) error {
+		meta.Body = append([]byte(nil), body...)
+		return store.Put(domain, key, &meta)
+	}}, nil
+}
+
+func (store *memoryCacheStore) Touch(domain, key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	element, ok := store.items[memoryCacheKey(domain, key)]
+	if !ok {
+		return ErrCacheMiss
+	}
+	element.Value.(*memoryCacheItem).modTime = time.Now()
+	return nil
+}
+
+func (store *memoryCacheStore) Delete(domain, key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if element, ok := store.items[memoryCacheKey(domain, key)]; ok {
+		store.removeElement(element)
+	}
+	return nil
+}
+
+func (store *memoryCacheStore) DeleteDomain(domain string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for element := store.ll.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*memoryCacheItem).domain == domain {
+			store.removeElement(element)
+		}
+		element = next
+	}
+	return nil
+}
+
+func (store *memoryCacheStore) Close() error {
+	return nil
+}
+
+func (store *memoryCacheStore) Stats() (CacheStats, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	stats := CacheStats{Type: "memory", Entries: int64(store.ll.Len()), Bytes: store.bytes, Domains: make(map[string]int64)}
+	for element := store.ll.Front(); element != nil; element = element.Next() {
+		item := element.Value.(*memoryCacheItem)
+		stats.Domains[item.domain] += int64(len(item.body))
+	}
+	return stats, nil
+}
+
+func (store *memoryCacheStore) Items() ([]CacheItem, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	items := make([]CacheItem, 0, store.ll.Len())
+	for element := store.ll.Front(); element != nil; element = element.Next() {
+		item := element.Value.(*memoryCacheItem)
+		items = append(items, CacheItem{Domain: item.domain, Id: item.key, Size: int64(len(item.body)), ModTime: item.modTime, AccessTime: item.accessTime})
+	}
+	return items, nil
+}
+
+func (store *memoryCacheStore) Remove(items []CacheItem) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, item := range items {
+		if element, ok := store.items[memoryCacheKey(item.Domain, item.Id)]; ok {
+			store.removeElement(element)
+		}
+	}
+	return nil
+}
+
+func (store *memoryCacheStore) removeElement(element *list.Element) {
+	item := element.Value.(*memoryCacheItem)
+	store.ll.Remove(element)
+	delete(store.items, memoryCacheKey(item.domain, item.key))
+	store.bytes -= int64(len(item.body))
+}
@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"os"
+	"path"
+	"time"
+)
+
+// sqliteCacheStore 使用单独的sqlite文件作为键值存储，避免大量小文件
+type sqliteCacheStore struct {
+	db *sql.DB
+}
+
+func newSqliteCacheStore(filename string) (*sqliteCacheStore, error) {
+	if dir := path.Dir(filename); !isExist(dir) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite3", filename+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`create table if not exists cache_entry (
+		domain varchar(100) not null,
+		cache_key varchar(1024) not null,
+		meta blob,
+		body blob,
+		size integer default 0,
+		mod_time integer not null,
+		access_time integer default 0,
+		primary key(domain, cache_key)
+)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	//旧版本的缓存库没有access_time，字段已存在时报错忽略
+	_, _ = db.Exec("alter table cache_entry add column access_time integer default 0")
+	return &sqliteCacheStore{db: db}, nil
+}
+
+func (store *sqliteCacheStore) Get(domain, key string) (*CacheEntry, error) {
+	var meta, body []byte
+	var modTime int64
+	err := store.db.QueryRow("select meta,body,mod_time from cache_entry where domain=? and cache_key=?", domain, key).Scan(&meta, &body, &modTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := new(CustomResponse)
+	if err = gob.NewDecoder(bytes.NewReader(meta)).Decode(resp); err != nil {
+		return nil, err
+	}
+	_, _ = store.db.Exec("update cache_entry set access_time=? where domain=? and cache_key=?", time.Now().Unix(), domain, key)
+	return &CacheEntry{Response: resp, Body: &bytesCacheBody{bytes.NewReader(body)}, ModTime: time.Unix(modTime, 0)}, nil
+}
+
+func (store *sqliteCacheStore) Put(domain, key string, resp *CustomResponse) error {
+	meta := *resp
+	meta.Body = nil
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&meta); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err := store.db.Exec("replace into cache_entry(domain,cache_key,meta,body,size,mod_time,access_time) values (?,?,?,?,?,?,?)",
+		domain, key, buf.Bytes(), resp.Body, len(resp.Body), now, now)
+	return err
+}
+
+func (store *sqliteCacheStore) Writer(domain, key string, resp *CustomResponse, limit int64) (CacheWriter, error) {
+	meta := *resp
+	return &bufferCacheWriter{limit: limit, commit: func(body []byte) error {
+		meta.Body = body
+		return store.Put(domain, key, &meta)
+	}}, nil
+}
+
+func (store *sqliteCacheStore) Touch(domain, key string) error {
+	_, err := store.db.Exec("update cache_entry set mod_time=? where domain=? and cache_key=?", time.Now().Unix(), domain, key)
+	return err
+}
+
+func (store *sqliteCacheStore) Delete(domain, key string) error {
+	_, err := store.db.Exec("delete from cache_entry where domain=? and cache_key=?", domain, key)
+	return err
+}
+
+func (store *sqliteCacheStore) DeleteDomain(domain string) error {
+	_, err := store.db.Exec("delete from cache_entry where domain=?", domain)
+	return err
+}
+
+func (store *sqliteCacheStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *sqliteCacheStore) Stats() (CacheStats, error) {
+	stats := CacheStats{Type: "sqlite", Domains: make(map[string]int64)}
+	rs, err := store.db.Query("select domain,count(*),sum(size) from cache_entry group by domain")
+	if err != nil {
+		return stats, err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var domain string
+		var count, size int64
+		if err = rs.Scan(&domain, &count, &size); err != nil {
+			return stats, err
+		}
+		stats.Entries += count
+		stats.Bytes += size
+		stats.Domains[domain] = size
+	}
+	return stats, rs.Err()
+}
+
+func (store *sqliteCacheStore) Items() ([]CacheItem, error) {
+	rs, err := store.db.Query("select domain,cache_key,size,mod_time,access_time from cache_entry")
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	items := make([]CacheItem, 0)
+	for rs.Next() {
+		var item CacheItem
+		var modTime, accessTime int64
+		if err = rs.Scan(&item.Domain, &item.Id, &item.Size, &modTime, &accessTime); err != nil {
+			return nil, err
+		}
+		item.ModTime = time.Unix(modTime, 0)
+		item.AccessTime = time.Unix(accessTime, 0)
+		items = append(items, item)
+	}
+	return items, rs.Err()
+}
+
+func (store *sqliteCacheStore) Remove(items []CacheItem) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, err = tx.Exec("delete from cache_entry where domain=? and cache_key=?", item.Domain, item.Id); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
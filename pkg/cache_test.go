@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func testCacheStores(t *testing.T) map[string]CacheStore {
+	dir := t.TempDir()
+	sqliteStore, err := newSqliteCacheStore(filepath.Join(dir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqliteStore.db.Close() })
+	return map[string]CacheStore{
+		"file":   newFileCacheStore(filepath.Join(dir, "file")),
+		"memory": newMemoryCacheStore(1024 * 1024),
+		"sqlite": sqliteStore,
+	}
+}
+
+func readCacheEntry(t *testing.T, store CacheStore, domain, key string) (*CacheEntry, string) {
+	entry, err := store.Get(domain, key)
+	if err != nil {
+		t.Fatalf("get %s%s: %v", domain, key, err)
+	}
+	defer entry.Body.Close()
+	body, err := io.ReadAll(entry.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry, string(body)
+}
+
+func TestCacheStore(t *testing.T) {
+	for name, store := range testCacheStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Get("a.com", "/"); err != ErrCacheMiss {
+				t.Fatalf("want ErrCacheMiss, got %v", err)
+			}
+			resp := &CustomResponse{StatusCode: 200, Body: []byte("hello"), Header: http.Header{"Content-Type": {"text/html"}}, ETag: `"v1"`}
+			if err := store.Put("a.com", "/", resp); err != nil {
+				t.Fatal(err)
+			}
+			entry, body := readCacheEntry(t, store, "a.com", "/")
+			if body != "hello" || entry.Response.StatusCode != 200 || entry.Response.ETag != `"v1"` || entry.Response.Header.Get("Content-Type") != "text/html" {
+				t.Fatalf("unexpected entry %+v body %q", entry.Response, body)
+			}
+			if entry.Body.Size() != 5 {
+				t.Fatalf("size = %d, want 5", entry.Body.Size())
+			}
+
+			if err := store.Touch("a.com", "/"); err != nil {
+				t.Fatal(err)
+			}
+			touched, _ := readCacheEntry(t, store, "a.com", "/")
+			if touched.ModTime.Before(entry.ModTime) {
+				t.Fatal("touch should not move ModTime back")
+			}
+
+			//Writer 提交后才能读到，中断的不保存
+			writer, err := store.Writer("a.com", "/stream", &CustomResponse{StatusCode: 200, Header: http.Header{}}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Write([]byte("part1 "))
+			writer.Write([]byte("part2"))
+			if err = writer.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if _, body = readCacheEntry(t, store, "a.com", "/stream"); body != "part1 part2" {
+				t.Fatalf("streamed body = %q", body)
+			}
+			writer, _ = store.Writer("a.com", "/aborted", &CustomResponse{StatusCode: 200, Header: http.Header{}}, 0)
+			writer.Write([]byte("x"))
+			writer.Abort()
+			if _, err = store.Get("a.com", "/aborted"); err != ErrCacheMiss {
+				t.Fatalf("aborted entry should not be saved, got %v", err)
+			}
+			writer, _ = store.Writer("a.com", "/large", &CustomResponse{StatusCode: 200, Header: http.Header{}}, 4)
+			if _, err = writer.Write([]byte("too large")); err == nil {
+				t.Fatal("want an error over the limit")
+			}
+			writer.Abort()
+
+			store.Put("b.com", "/", resp)
+			items, err := store.Items()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 3 {
+				t.Fatalf("items = %d, want 3", len(items))
+			}
+			stats, err := store.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Entries != 3 || stats.Domains["a.com"] == 0 || stats.Domains["b.com"] == 0 {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+
+			if err = store.Delete("a.com", "/stream"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.Get("a.com", "/stream"); err != ErrCacheMiss {
+				t.Fatalf("deleted entry still cached: %v", err)
+			}
+			if err = store.DeleteDomain("a.com"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.Get("a.com", "/"); err != ErrCacheMiss {
+				t.Fatalf("domain entry still cached: %v", err)
+			}
+
+			items, _ = store.Items()
+			if len(items) != 1 || items[0].Domain != "b.com" {
+				t.Fatalf("unexpected items %+v", items)
+			}
+			if err = store.Remove(items); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.Get("b.com", "/"); err != ErrCacheMiss {
+				t.Fatalf("removed entry still cached: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryCacheStoreEvicts(t *testing.T) {
+	store := newMemoryCacheStore(10)
+	store.Put("a.com", "/1", &CustomResponse{Body: []byte("123456")})
+	store.Put("a.com", "/2", &CustomResponse{Body: []byte("123456")})
+	if _, err := store.Get("a.com", "/1"); err != ErrCacheMiss {
+		t.Fatal("least recently used entry should be evicted")
+	}
+	if _, err := store.Get("a.com", "/2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("a.com", "/3", &CustomResponse{Body: make([]byte, 11)}); err != errCacheTooLarge {
+		t.Fatalf("want errCacheTooLarge, got %v", err)
+	}
+}
@@ -3,9 +3,11 @@ package pkg
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
@@ -18,7 +20,9 @@ import (
 	"unicode/utf8"
 
 	"github.com/wenzhenxi/gorsa"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/html/charset"
+	"golang.org/x/net/http2"
 )
 
 func GetHost(request *http.Request) string {
@@ -67,13 +71,32 @@ func GBk2UTF8(content []byte, contentType string) []byte {
 	return content
 }
 
-func newProxy(target *url.URL, ipList []net.IP) *httputil.ReverseProxy {
-	targetQuery := target.RawQuery
+// newProxy target 返回这次请求使用的源站，enableHttp2 为true时 https 源站通过 ALPN 协商 HTTP/2
+// upstreamConnectTimeout 源站宕机时每个请求最多等待这么久才回退到缓存
+func upstreamConnectTimeout(appConfig *AppConfig) time.Duration {
+	if appConfig.UpstreamConnectTimeout <= 0 {
+		return defaultConnectTimeout * time.Second
+	}
+	return time.Duration(appConfig.UpstreamConnectTimeout) * time.Second
+}
+
+func newProxy(target func(req *http.Request) *url.URL, ipList []net.IP, enableHttp2 bool, connectTimeout time.Duration) (*httputil.ReverseProxy, error) {
 	director := func(req *http.Request) {
+		target := target(req)
+		targetQuery := target.RawQuery
 		req.Host = target.Host
 		req.Header.Set("Referer", target.Scheme+"://"+target.Host)
+		//客户端的条件请求由缓存处理，源站需要返回完整内容
 		req.Header.Del("If-Modified-Since")
 		req.Header.Del("If-None-Match")
+		if revalidate, ok := req.Context().Value(REVALIDATE).(*revalidation); ok {
+			if revalidate.response.ETag != "" {
+				req.Header.Set("If-None-Match", revalidate.response.ETag)
+			}
+			if revalidate.response.LastModified != "" {
+				req.Header.Set("If-Modified-Since", revalidate.response.LastModified)
+			}
+		}
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
@@ -89,6 +112,8 @@ func newProxy(target *url.URL, ipList []net.IP) *httputil.ReverseProxy {
 	}
 
 	transport := &http.Transport{
+		//站点重建后原来的连接在空闲后关闭
+		IdleConnTimeout: 90 * time.Second,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			var localIp net.IP = net.IPv4(0, 0, 0, 0)
 			if len(ipList) > 0 {
@@ -98,13 +123,21 @@ func newProxy(target *url.URL, ipList []net.IP) *httputil.ReverseProxy {
 			localAddr := &net.TCPAddr{IP: localIp, Port: 0, Zone: ""}
 			var dialer = net.Dialer{
 				LocalAddr: localAddr,
-				Timeout:   30 * time.Second,
+				Timeout:   connectTimeout,
 				KeepAlive: 30 * time.Second,
 			}
 			return dialer.DialContext(ctx, network, addr)
 		},
 	}
-	return &httputil.ReverseProxy{Director: director, Transport: transport}
+	if enableHttp2 {
+		h2Transport, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_http2 配置错误: %w", err)
+		}
+		//长时间没有数据时发送ping，及时发现断开的连接
+		h2Transport.ReadIdleTimeout = 30 * time.Second
+	}
+	return &httputil.ReverseProxy{Director: director, Transport: transport}, nil
 }
 func GetIPList() ([]net.IP, error) {
 	ipList := make([]net.IP, 0)
@@ -164,12 +197,15 @@ func RandStr(minLength int, maxLength int) string {
 
 }
 func readLinks() map[string][]string {
-	result := make(map[string][]string)
 	linkData, err := os.ReadFile("config/links.txt")
 	if err != nil && len(linkData) <= 0 {
-		return result
+		return make(map[string][]string)
 	}
-	linkLines := strings.Split(strings.ReplaceAll(string(linkData), "\r", ""), "\n")
+	return parseLinks(string(linkData))
+}
+func parseLinks(content string) map[string][]string {
+	result := make(map[string][]string)
+	linkLines := strings.Split(strings.ReplaceAll(content, "\r", ""), "\n")
 	for _, line := range linkLines {
 		linkArr := strings.Split(line, "||")
 		if len(linkArr) < 2 {
@@ -242,35 +278,106 @@ XzFBxZbhjXaZkaO2CWTHLwcKtSCCd3PkXNCRWQeHM4OelRZJajKSxwcWWTqbusGC
 	}
 	return data, nil
 }
-func genUserAndPass() (string, string) {
-	chars := []rune("abcdefghijklmnopqrstuvwxyz")
-	user := ""
-	for i := 0; i < 8; i++ {
-		user = user + string(chars[rand.Intn(len(chars))])
-	}
-	chars = []rune("abcdefghijklmnopqrstuvwxyz1234567890")
-	pass := ""
-	for i := 0; i < 12; i++ {
-		pass = pass + string(chars[rand.Intn(len(chars))])
-	}
-	return user, pass
+
+// genUserAndPass 使用 crypto/rand，math/rand 按启动时间播种，生成的密码可以被猜出来
+func genUserAndPass() (string, string, error) {
+	user, err := secureRandomString("abcdefghijklmnopqrstuvwxyz", 8)
+	if err != nil {
+		return "", "", err
+	}
+	pass, err := secureRandomString("abcdefghijklmnopqrstuvwxyz1234567890", 12)
+	if err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
 }
-func makeAdminUser() (string, string, error) {
-	passBytes, err := os.ReadFile("config/passwd")
-	if err != nil || len(passBytes) == 0 {
-		userName, password := genUserAndPass()
-		err = os.WriteFile("config/passwd", []byte(userName+":"+password), os.ModePerm)
+
+func secureRandomString(chars string, length int) (string, error) {
+	result := make([]byte, length)
+	max := big.NewInt(int64(len(chars)))
+	for i := range result {
+		n, err := cryptorand.Int(cryptorand.Reader, max)
 		if err != nil {
-			return "", "", errors.New("生成用户文件错误" + err.Error())
+			return "", err
 		}
-		return userName, password, nil
+		result[i] = chars[n.Int64()]
+	}
+	return string(result), nil
+}
+
+const passwdFile = "config/passwd"
 
+// makeAdminUser 没有后台用户时创建管理员，旧版本 config/passwd 中的账号会导入为管理员
+// 随机生成账号时 initPassword 为生成的明文密码
+func makeAdminUser(dao *Dao) (userName string, initPassword string, err error) {
+	count, err := dao.CountUser()
+	if err != nil || count > 0 {
+		return "", "", err
+	}
+	var passwordHash string
+	passBytes, readErr := os.ReadFile(passwdFile)
+	userAndPass := strings.SplitN(strings.TrimSpace(string(passBytes)), ":", 2)
+	if readErr == nil && len(userAndPass) == 2 && userAndPass[0] != "" && userAndPass[1] != "" {
+		userName, passwordHash = userAndPass[0], userAndPass[1]
+		if _, costErr := bcrypt.Cost([]byte(passwordHash)); costErr != nil {
+			//旧版本保存的是明文密码
+			if passwordHash, err = hashPassword(passwordHash); err != nil {
+				return "", "", err
+			}
+		}
+	} else {
+		if userName, initPassword, err = genUserAndPass(); err != nil {
+			return "", "", err
+		}
+		if passwordHash, err = hashPassword(initPassword); err != nil {
+			return "", "", err
+		}
 	}
-	userAndPass := strings.Split(string(passBytes), ":")
-	if len(userAndPass) != 2 {
-		return "", "", errors.New("用户文件内容错误")
+	err = dao.SaveUser(&AdminAccount{UserName: userName, PasswordHash: passwordHash, Role: RoleAdmin, CreatedTime: time.Now().Unix()})
+	if err != nil {
+		return "", "", errors.New("创建管理员错误" + err.Error())
+	}
+	if readErr == nil {
+		_ = os.Rename(passwdFile, passwdFile+".imported")
+	}
+	return userName, initPassword, nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("密码至少8位")
+	}
+	if len(password) > 72 {
+		return errors.New("密码不能超过72位")
+	}
+	return nil
+}
+
+// SetAdminPassword 命令行重置密码，用户不存在时创建为管理员
+func SetAdminPassword(dao *Dao, userName, password string) error {
+	if strings.TrimSpace(userName) == "" {
+		return errors.New("用户名不能为空")
+	}
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	affected, err := dao.SetUserPassword(userName, passwordHash)
+	if err != nil || affected > 0 {
+		return err
 	}
-	return userAndPass[0], userAndPass[1], nil
+	return dao.SaveUser(&AdminAccount{UserName: userName, PasswordHash: passwordHash, Role: RoleAdmin, CreatedTime: time.Now().Unix()})
 }
 
 func HtmlEntities(input string) string {
@@ -308,6 +415,23 @@ func Escape(content string) string {
 	content = strings.ReplaceAll(content, "\r", "&#13;")
 	return content
 }
+
+// ParseDateTime 解析后台传入的时间，格式为 2006-01-02 15:04:05 或 2006-01-02
+func ParseDateTime(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	layout := "2006-01-02 15:04:05"
+	if len(value) == len("2006-01-02") {
+		layout = "2006-01-02"
+	}
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
 func IsUTF8(content []byte) bool {
 	for i := len(content) - 1; i >= 0 && i > len(content)-4; i-- {
 		b := content[i]
@@ -0,0 +1,18 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestNewSiteUpstreamHttp2(t *testing.T) {
+	app := newTestApp(t)
+	for _, enable := range []bool{false, true} {
+		site, err := newSite(&SiteConfig{Domain: "example.com", Url: "https://origin.example.com"}, app, &AppConfig{UpstreamHttp2: enable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := site.transport.TLSNextProto["h2"]; ok != enable {
+			t.Fatalf("upstream_http2=%v, h2 configured=%v", enable, ok)
+		}
+	}
+}
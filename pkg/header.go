@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+
+	maxHeaderRules = 100
+)
+
+var (
+	headerActions = map[string]bool{HeaderAdd: true, HeaderSet: true, HeaderRemove: true}
+	//由代理自己处理的响应头，规则不能修改
+	reservedHeaders = map[string]bool{"Content-Length": true, "Content-Encoding": true, "Transfer-Encoding": true, "Connection": true, "Trailer": true, "Upgrade": true}
+)
+
+// HeaderRule 站点的响应头规则，按在 SiteConfig.HeaderRules 中的顺序执行
+type HeaderRule struct {
+	Id     int    `json:"-"`
+	SiteId int    `json:"-"`
+	Sort   int    `json:"-"`
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	//页面路径，* 匹配任意字符，为空时不限制
+	Paths []string `json:"paths,omitempty"`
+	//响应的内容类型，比如 text/css、image/*，为空时不限制
+	ContentTypes []string `json:"content_types,omitempty"`
+	Enabled      bool     `json:"enabled"`
+}
+
+// UnmarshalJSON 没有 enabled 字段时默认启用，未知字段报错
+func (rule *HeaderRule) UnmarshalJSON(data []byte) error {
+	type plainRule HeaderRule
+	item := plainRule{Enabled: true}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&item); err != nil {
+		return err
+	}
+	*rule = HeaderRule(item)
+	return nil
+}
+
+// validateHeaderRules 检查响应头规则，响应头名称转成标准格式，内容类型转成小写
+func validateHeaderRules(rules []HeaderRule) error {
+	if len(rules) > maxHeaderRules {
+		return fmt.Errorf("响应头规则不能超过%d条", maxHeaderRules)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if !headerActions[rule.Action] {
+			return fmt.Errorf("第%d条响应头规则的操作 %s 错误", i+1, rule.Action)
+		}
+		rule.Name = strings.TrimSpace(rule.Name)
+		if !httpguts.ValidHeaderFieldName(rule.Name) {
+			return fmt.Errorf("第%d条响应头规则的名称 %s 错误", i+1, rule.Name)
+		}
+		rule.Name = http.CanonicalHeaderKey(rule.Name)
+		if reservedHeaders[rule.Name] {
+			return fmt.Errorf("第%d条响应头规则不能修改 %s", i+1, rule.Name)
+		}
+		if rule.Action == HeaderRemove {
+			rule.Value = ""
+		} else if rule.Value == "" || !httpguts.ValidHeaderFieldValue(rule.Value) {
+			return fmt.Errorf("第%d条响应头规则 %s 的值错误", i+1, rule.Name)
+		}
+		if err := validatePaths(rule.Paths); err != nil {
+			return fmt.Errorf("第%d条响应头规则的%w", i+1, err)
+		}
+		for j, item := range rule.ContentTypes {
+			item = strings.ToLower(strings.TrimSpace(item))
+			if item == "" || strings.ContainsAny(item, " ,;\n") {
+				return fmt.Errorf("第%d条响应头规则的内容类型 %s 错误", i+1, rule.ContentTypes[j])
+			}
+			rule.ContentTypes[j] = item
+		}
+	}
+	return nil
+}
+
+// headerRule 创建站点时预先编译的响应头规则
+type headerRule struct {
+	action       string
+	name         string
+	value        string
+	paths        *regexp.Regexp
+	contentTypes *regexp.Regexp
+}
+
+func newHeaderRules(rules []HeaderRule) []headerRule {
+	results := make([]headerRule, 0, len(rules))
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		results = append(results, headerRule{
+			action:       rule.Action,
+			name:         rule.Name,
+			value:        rule.Value,
+			paths:        globRegexp(rule.Paths),
+			contentTypes: globRegexp(rule.ContentTypes),
+		})
+	}
+	return results
+}
+
+// applyHeaderRules 修改发给客户端的响应头，源站响应、缓存和出错时都要调用，缓存里保存的是没有修改的响应头
+func (site *Site) applyHeaderRules(header http.Header, requestPath string) {
+	if len(site.headerRules) == 0 {
+		return
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	if index := strings.IndexByte(contentType, ';'); index >= 0 {
+		contentType = contentType[:index]
+	}
+	contentType = strings.TrimSpace(contentType)
+	for _, rule := range site.headerRules {
+		if rule.paths != nil && !rule.paths.MatchString(requestPath) {
+			continue
+		}
+		if rule.contentTypes != nil && !rule.contentTypes.MatchString(contentType) {
+			continue
+		}
+		switch rule.action {
+		case HeaderAdd:
+			header.Add(rule.name, rule.value)
+		case HeaderSet:
+			header.Set(rule.name, rule.value)
+		case HeaderRemove:
+			header.Del(rule.name)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+
+	defaultHealthInterval = 10
+	defaultBreakerTimeout = 30
+	defaultConnectTimeout = 10
+)
+
+var errBreakerOpen = errors.New("源站熔断中，暂不回源")
+
+// originState 源站的熔断和健康检查状态。连续失败 breaker_failures 次后熔断，
+// 熔断期间不回源，直接使用缓存或错误页，breaker_timeout 秒后放行一个请求试探，成功后恢复
+type originState struct {
+	url            *url.URL
+	failuresToOpen int
+	openTimeout    time.Duration
+	//配置了 health_path，健康检查失败时不回源
+	healthCheck bool
+	inflight    int64
+
+	lock      sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	lastError string
+	errorTime time.Time
+	probing   bool
+	probeTime time.Time
+	probeOk   bool
+	//成功请求的平均耗时，least_latency 使用
+	latency time.Duration
+}
+
+func newOriginState(u *url.URL, upstream *UpstreamConfig) *originState {
+	timeout := upstream.BreakerTimeout
+	if timeout <= 0 {
+		timeout = defaultBreakerTimeout
+	}
+	return &originState{
+		url:            u,
+		failuresToOpen: upstream.BreakerFailures,
+		openTimeout:    time.Duration(timeout) * time.Second,
+		healthCheck:    upstream.HealthPath != "",
+		state:          BreakerClosed,
+	}
+}
+
+// down 最近一次健康检查失败，不管有没有开启熔断都不回源，检查恢复后再回源
+func (origin *originState) down() bool {
+	return origin.healthCheck && !origin.probeTime.IsZero() && !origin.probeOk
+}
+
+// allow 熔断或健康检查失败时返回false，熔断到时间后只放行一个试探请求
+func (origin *originState) allow() bool {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	if origin.down() {
+		return false
+	}
+	switch origin.state {
+	case BreakerOpen:
+		if time.Since(origin.openedAt) < origin.openTimeout {
+			return false
+		}
+		origin.state = BreakerHalfOpen
+		origin.trial = true
+		return true
+	case BreakerHalfOpen:
+		if origin.trial {
+			return false
+		}
+		origin.trial = true
+		return true
+	}
+	return true
+}
+
+// available 没有熔断或者可以试探，并且健康检查没有失败，不修改状态
+func (origin *originState) available() bool {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	if origin.down() {
+		return false
+	}
+	switch origin.state {
+	case BreakerOpen:
+		return time.Since(origin.openedAt) >= origin.openTimeout
+	case BreakerHalfOpen:
+		return !origin.trial
+	}
+	return true
+}
+
+// observe 记录成功请求的耗时，新的耗时占五分之一
+func (origin *originState) observe(latency time.Duration) {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	if origin.latency == 0 {
+		origin.latency = latency
+	} else {
+		origin.latency = (origin.latency*4 + latency) / 5
+	}
+}
+
+func (origin *originState) averageLatency() time.Duration {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	return origin.latency
+}
+
+func (origin *originState) success() {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	origin.failures = 0
+	origin.state = BreakerClosed
+	origin.trial = false
+}
+
+func (origin *originState) failure(msg string) {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	origin.failures++
+	origin.lastError = msg
+	origin.errorTime = time.Now()
+	if origin.failuresToOpen <= 0 {
+		return
+	}
+	if origin.state == BreakerHalfOpen || origin.state == BreakerClosed && origin.failures >= origin.failuresToOpen {
+		origin.state = BreakerOpen
+		origin.openedAt = time.Now()
+		origin.trial = false
+	}
+}
+
+// OriginStatus 后台站点列表显示的源站状态
+type OriginStatus struct {
+	Url       string `json:"url"`
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	Inflight  int64  `json:"inflight"`
+	LastError string `json:"last_error"`
+	ErrorTime int64  `json:"error_time"`
+	//没有健康检查时为0
+	ProbeTime int64 `json:"probe_time"`
+	ProbeOk   bool  `json:"probe_ok"`
+	//平均耗时毫秒
+	Latency int64 `json:"latency"`
+}
+
+func (origin *originState) Status() OriginStatus {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	status := OriginStatus{
+		Url:       origin.url.String(),
+		State:     origin.state,
+		Failures:  origin.failures,
+		Inflight:  atomic.LoadInt64(&origin.inflight),
+		LastError: origin.lastError,
+		ProbeOk:   origin.probeOk,
+		Latency:   origin.latency.Milliseconds(),
+	}
+	//熔断时间已到但还没有请求试探时也显示为半开
+	if status.State == BreakerOpen && time.Since(origin.openedAt) >= origin.openTimeout {
+		status.State = BreakerHalfOpen
+	}
+	if !origin.errorTime.IsZero() {
+		status.ErrorTime = origin.errorTime.Unix()
+	}
+	if !origin.probeTime.IsZero() {
+		status.ProbeTime = origin.probeTime.Unix()
+	}
+	return status
+}
+
+// originTransport 熔断时不回源，并按响应结果更新 originTarget 选择的源站的熔断状态，5xx 也算失败。
+// 还有其他源站时 5xx 转成错误，由 retryOrigin 换下一个源站
+type originTransport struct {
+	http.RoundTripper
+	pool *originPool
+}
+
+func (transport *originTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	origin := transport.pool.origins[0]
+	attempt, _ := request.Context().Value(ORIGIN_ATTEMPT).(*originAttempt)
+	if attempt != nil && attempt.current != nil {
+		origin = attempt.current
+	}
+	if !origin.allow() {
+		if attempt != nil {
+			attempt.failed = true
+		}
+		return nil, errBreakerOpen
+	}
+	atomic.AddInt64(&origin.inflight, 1)
+	defer atomic.AddInt64(&origin.inflight, -1)
+	start := time.Now()
+	response, err := transport.RoundTripper.RoundTrip(request)
+	switch {
+	case err != nil:
+		//客户端断开不算源站失败
+		if request.Context().Err() == nil {
+			origin.failure(err.Error())
+			if attempt != nil {
+				attempt.failed = true
+			}
+		} else {
+			origin.cancelTrial()
+		}
+	case response.StatusCode >= 500:
+		msg := "源站返回 " + strconv.Itoa(response.StatusCode)
+		origin.failure(msg)
+		if transport.pool.canRetry(attempt, request) {
+			_ = response.Body.Close()
+			attempt.failed = true
+			return nil, errors.New(msg)
+		}
+	default:
+		origin.success()
+		origin.observe(time.Since(start))
+	}
+	return response, err
+}
+
+// cancelTrial 试探请求被客户端取消时允许下一个请求继续试探
+func (origin *originState) cancelTrial() {
+	origin.lock.Lock()
+	origin.trial = false
+	origin.lock.Unlock()
+}
+
+// dueProbe 到检查时间且上次检查已结束时返回true
+func (origin *originState) dueProbe(interval time.Duration) bool {
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	if origin.probing || time.Since(origin.probeTime) < interval {
+		return false
+	}
+	origin.probing = true
+	return true
+}
+
+// probe 请求源站的 health_path，2xx、3xx 为正常。检查结果同样更新熔断状态，源站恢复后不用等试探请求
+func (site *Site) probe(origin *originState, interval time.Duration) {
+	timeout := interval
+	if timeout > 10*time.Second {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	probeUrl := *origin.url
+	probeUrl.Path = singleJoiningSlash(origin.url.Path, site.Upstream.HealthPath)
+	probeUrl.RawQuery = ""
+	ok := false
+	msg := ""
+	var elapsed time.Duration
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probeUrl.String(), nil)
+	if err == nil {
+		site.applyUpstream(request)
+		var response *http.Response
+		start := time.Now()
+		response, err = site.transport.RoundTrip(request)
+		if err == nil {
+			elapsed = time.Since(start)
+			_ = response.Body.Close()
+			ok = response.StatusCode < 400
+			msg = "健康检查返回 " + strconv.Itoa(response.StatusCode)
+		}
+	}
+	if err != nil {
+		msg = "健康检查失败: " + err.Error()
+	}
+	if ok {
+		origin.success()
+		origin.observe(elapsed)
+	} else {
+		origin.failure(msg)
+	}
+	origin.lock.Lock()
+	origin.probing = false
+	origin.probeTime = time.Now()
+	origin.probeOk = ok
+	origin.lock.Unlock()
+}
+
+// startHealthCheck 每秒检查一次哪些源站到了健康检查时间
+func (app *Application) startHealthCheck() {
+	app.healthStop = make(chan struct{})
+	app.healthDone = make(chan struct{})
+	go func() {
+		defer close(app.healthDone)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.healthStop:
+				return
+			case <-ticker.C:
+				app.Sites.Range(func(key, value any) bool {
+					site := value.(*Site)
+					if site.Upstream.HealthPath == "" {
+						return true
+					}
+					interval := time.Duration(site.Upstream.HealthInterval) * time.Second
+					if interval <= 0 {
+						interval = defaultHealthInterval * time.Second
+					}
+					for _, origin := range site.pool.origins {
+						if origin.dueProbe(interval) {
+							go site.probe(origin, interval)
+						}
+					}
+					return true
+				})
+			}
+		}
+	}()
+}
+
+func (app *Application) stopHealthCheck() {
+	if app.healthStop == nil {
+		return
+	}
+	close(app.healthStop)
+	<-app.healthDone
+	app.healthStop = nil
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBreakerStateMachine(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	origin := newOriginState(u, &UpstreamConfig{BreakerFailures: 2, BreakerTimeout: 60})
+
+	origin.failure("1")
+	if !origin.allow() || origin.Status().State != BreakerClosed {
+		t.Fatal("one failure should not open the breaker")
+	}
+	origin.failure("2")
+	if origin.allow() || origin.available() || origin.Status().State != BreakerOpen {
+		t.Fatal("breaker should open after breaker_failures failures")
+	}
+
+	//熔断时间到了只放行一个试探请求
+	origin.lock.Lock()
+	origin.openedAt = time.Now().Add(-time.Minute)
+	origin.lock.Unlock()
+	if origin.Status().State != BreakerHalfOpen || !origin.available() {
+		t.Fatal("breaker should show half open after the timeout")
+	}
+	if !origin.allow() {
+		t.Fatal("first request after the timeout should be the trial")
+	}
+	if origin.allow() || origin.available() {
+		t.Fatal("only one trial request at a time")
+	}
+
+	//试探被客户端取消，下一个请求继续试探
+	origin.cancelTrial()
+	if !origin.allow() {
+		t.Fatal("trial should be released after cancel")
+	}
+
+	//试探失败重新熔断
+	origin.failure("trial")
+	if origin.allow() || origin.Status().State != BreakerOpen {
+		t.Fatal("failed trial should reopen the breaker")
+	}
+
+	origin.lock.Lock()
+	origin.openedAt = time.Now().Add(-time.Minute)
+	origin.lock.Unlock()
+	if !origin.allow() {
+		t.Fatal("want a trial request")
+	}
+	origin.success()
+	status := origin.Status()
+	if status.State != BreakerClosed || status.Failures != 0 || !origin.allow() || !origin.allow() {
+		t.Fatalf("successful trial should close the breaker: %+v", status)
+	}
+	if status.LastError != "trial" {
+		t.Fatalf("last error = %q, want trial", status.LastError)
+	}
+
+	//breaker_failures 为0不熔断
+	disabled := newOriginState(u, &UpstreamConfig{})
+	for i := 0; i < 10; i++ {
+		disabled.failure("down")
+	}
+	if !disabled.allow() || disabled.Status().State != BreakerClosed || disabled.Status().Failures != 10 {
+		t.Fatal("breaker should stay closed when breaker_failures is 0")
+	}
+}
+
+func TestStoreSiteKeepsOriginState(t *testing.T) {
+	app := newTestApp(t)
+	upstream := UpstreamConfig{BreakerFailures: 1, BreakerTimeout: 60}
+	site := newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: "http://127.0.0.1:1", Upstream: upstream})
+	site.pool.origins[0].failure("down")
+	if site.pool.origins[0].available() {
+		t.Fatal("breaker should be open")
+	}
+
+	//只加备用源站，原来源站的熔断状态不变
+	resaved := &SiteConfig{Domain: "example.com", Url: "http://127.0.0.1:1", Upstream: upstream}
+	resaved.Upstream.Origins = []string{"http://127.0.0.1:2"}
+	if err := validateSiteConfig(resaved, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSite(resaved, app); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := app.querySite("example.com")
+	if current == site {
+		t.Fatal("site should be rebuilt")
+	}
+	if current.pool.origins[0] != site.pool.origins[0] || current.pool.origins[0].Status().State != BreakerOpen {
+		t.Fatal("open breaker should be kept when the upstream settings are unchanged")
+	}
+	if current.pool.origins[1].Status().State != BreakerClosed {
+		t.Fatal("new origin should start closed")
+	}
+
+	//熔断设置变了，重新开始
+	changed := &SiteConfig{Domain: "example.com", Url: "http://127.0.0.1:1", Upstream: UpstreamConfig{BreakerFailures: 3}}
+	if err := validateSiteConfig(changed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewSite(changed, app); err != nil {
+		t.Fatal(err)
+	}
+	current, _ = app.querySite("example.com")
+	if current.pool.origins[0].Status().State != BreakerClosed {
+		t.Fatal("breaker should reset when the breaker settings change")
+	}
+
+	app.deleteSite("example.com")
+	if _, ok := app.Sites.Load("example.com"); ok {
+		t.Fatal("site should be removed")
+	}
+}
+
+func TestProbeFailureSkipsOrigin(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	//breaker_failures 为0，只靠健康检查
+	origin := newOriginState(u, &UpstreamConfig{HealthPath: "/health"})
+	if !origin.allow() || !origin.available() {
+		t.Fatal("origin should be used before the first probe")
+	}
+	origin.lock.Lock()
+	origin.probeTime, origin.probeOk = time.Now(), false
+	origin.lock.Unlock()
+	if origin.allow() || origin.available() {
+		t.Fatal("origin should be skipped after a failed probe")
+	}
+	origin.lock.Lock()
+	origin.probeOk = true
+	origin.lock.Unlock()
+	if !origin.allow() || !origin.available() {
+		t.Fatal("origin should be used again after the probe recovers")
+	}
+
+	//没有配置 health_path 不受影响
+	unchecked := newOriginState(u, &UpstreamConfig{})
+	unchecked.probeTime = time.Now()
+	if !unchecked.allow() || !unchecked.available() {
+		t.Fatal("probe result should be ignored without health_path")
+	}
+}
+
+func TestUpstreamConnectTimeout(t *testing.T) {
+	if got := upstreamConnectTimeout(&AppConfig{}); got != defaultConnectTimeout*time.Second {
+		t.Fatalf("default timeout = %v", got)
+	}
+	if got := upstreamConnectTimeout(&AppConfig{UpstreamConnectTimeout: 3}); got != 3*time.Second {
+		t.Fatalf("timeout = %v, want 3s", got)
+	}
+	appConfig := &AppConfig{Port: "80", AdminPort: "81", CachePath: "cache", AdminUri: "/admin", InjectJsPath: "/inject.js"}
+	if err := appConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	appConfig.UpstreamConnectTimeout = -1
+	if err := appConfig.Validate(); err == nil {
+		t.Fatal("negative upstream_connect_timeout should be rejected")
+	}
+}
@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// startJanitor 后台定时清理过期缓存，并按容量限制淘汰最久未访问的缓存
+func (app *Application) startJanitor() {
+	app.janitorStop = make(chan struct{})
+	app.janitorDone = make(chan struct{})
+	go func() {
+		defer close(app.janitorDone)
+		for {
+			interval := time.Duration(app.Config().CacheCleanInterval) * time.Minute
+			if interval <= 0 {
+				interval = 10 * time.Minute
+			}
+			timer := time.NewTimer(interval)
+			select {
+			case <-app.janitorStop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				app.cleanCache()
+			}
+		}
+	}()
+}
+
+func (app *Application) stopJanitor() {
+	if app.janitorStop == nil {
+		return
+	}
+	close(app.janitorStop)
+	<-app.janitorDone
+	app.janitorStop = nil
+}
+
+type evictStat struct {
+	count int
+	bytes int64
+}
+
+func (app *Application) cleanCache() {
+	store := app.CacheStore()
+	if store == nil {
+		return
+	}
+	items, err := store.Items()
+	if err != nil {
+		app.Logger.Error("janitor list cache error", err.Error())
+		return
+	}
+	appConfig := app.Config()
+	now := time.Now()
+	keep := time.Duration(appConfig.CacheExpiredKeep) * time.Minute
+	evicted := make([]CacheItem, 0)
+	stats := make(map[string]*evictStat)
+	evict := func(item CacheItem, reason string) {
+		evicted = append(evicted, item)
+		key := item.Domain + " " + reason
+		if stats[key] == nil {
+			stats[key] = &evictStat{}
+		}
+		stats[key].count++
+		stats[key].bytes += item.Size
+	}
+
+	remain := make([]CacheItem, 0, len(items))
+	for _, item := range items {
+		value, ok := app.Sites.Load(item.Domain)
+		if !ok {
+			evict(item, "站点不存在")
+			continue
+		}
+		site := value.(*Site)
+		//过期后保留一段时间，源站出错时还可以返回旧缓存
+		expire := time.Duration(site.CacheTime)*time.Minute + keep
+		if stale := time.Duration(site.StaleTime) * time.Minute; stale > keep {
+			expire = time.Duration(site.CacheTime)*time.Minute + stale
+		}
+		if now.Sub(item.ModTime) > expire {
+			evict(item, "过期")
+			continue
+		}
+		remain = append(remain, item)
+	}
+	//最久未访问的排在前面
+	sort.Slice(remain, func(i, j int) bool {
+		return remain[i].AccessTime.Before(remain[j].AccessTime)
+	})
+
+	if maxDomain := appConfig.CacheMaxDomain * 1024 * 1024; maxDomain > 0 {
+		domainBytes := make(map[string]int64)
+		for _, item := range remain {
+			domainBytes[item.Domain] += item.Size
+		}
+		kept := remain[:0]
+		for _, item := range remain {
+			if domainBytes[item.Domain] > maxDomain {
+				domainBytes[item.Domain] -= item.Size
+				evict(item, "超出站点容量")
+				continue
+			}
+			kept = append(kept, item)
+		}
+		remain = kept
+	}
+	if maxTotal := appConfig.CacheMaxTotal * 1024 * 1024; maxTotal > 0 {
+		var total int64
+		for _, item := range remain {
+			total += item.Size
+		}
+		for _, item := range remain {
+			if total <= maxTotal {
+				break
+			}
+			total -= item.Size
+			evict(item, "超出总容量")
+		}
+	}
+	if len(evicted) == 0 {
+		return
+	}
+	if err = store.Remove(evicted); err != nil {
+		app.Logger.Error("janitor remove cache error", err.Error())
+		return
+	}
+	for key, stat := range stats {
+		app.Logger.Info(fmt.Sprintf("清理缓存 %s: %d个 %d字节", key, stat.count, stat.bytes))
+	}
+}
@@ -0,0 +1,262 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"
+	CacheStale  = "stale"
+	CacheBypass = "bypass"
+
+	//缓存占用需要遍历缓存目录，抓取频繁时使用上次的结果
+	cacheStatsTTL = time.Minute
+)
+
+var (
+	statusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+	cacheResults  = []string{CacheHit, CacheMiss, CacheStale, CacheBypass}
+	originBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	renderBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+)
+
+// histogram 固定区间的直方图，counts[i] 是小于等于 buckets[i] 的次数，不累加
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     uint64 //float64 的位
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	index := sort.SearchFloat64s(h.buckets, value)
+	if index < len(h.counts) {
+		atomic.AddUint64(&h.counts[index], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// siteMetrics 单个站点的统计，按配置的域名保存，站点重新创建时继续累加
+type siteMetrics struct {
+	requests    [6]uint64 //下标是状态码的第一位
+	cache       [4]uint64 //顺序和 cacheResults 相同
+	originError uint64
+	originBytes uint64
+	sentBytes   uint64
+	origin      *histogram
+	render      *histogram
+}
+
+func newSiteMetrics() *siteMetrics {
+	return &siteMetrics{origin: newHistogram(originBuckets), render: newHistogram(renderBuckets)}
+}
+
+func (metrics *siteMetrics) addRequest(status int, sent int64) {
+	if class := status / 100; class >= 1 && class <= 5 {
+		atomic.AddUint64(&metrics.requests[class], 1)
+	}
+	atomic.AddUint64(&metrics.sentBytes, uint64(sent))
+}
+
+func (metrics *siteMetrics) addOriginError() {
+	atomic.AddUint64(&metrics.originError, 1)
+}
+
+func (metrics *siteMetrics) addCache(result string) {
+	for i, item := range cacheResults {
+		if item == result {
+			atomic.AddUint64(&metrics.cache[i], 1)
+			return
+		}
+	}
+}
+
+// siteMetrics 返回域名的统计，没有时创建
+func (app *Application) siteMetrics(domain string) *siteMetrics {
+	if value, ok := app.metrics.Load(domain); ok {
+		return value.(*siteMetrics)
+	}
+	value, _ := app.metrics.LoadOrStore(domain, newSiteMetrics())
+	return value.(*siteMetrics)
+}
+
+// metricsTransport 统计回源耗时和从源站收到的字节数
+type metricsTransport struct {
+	http.RoundTripper
+	metrics *siteMetrics
+}
+
+func (transport *metricsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := transport.RoundTripper.RoundTrip(request)
+	transport.metrics.origin.observe(time.Since(start).Seconds())
+	if err == nil {
+		response.Body = &countingBody{ReadCloser: response.Body, count: &transport.metrics.originBytes}
+	}
+	return response, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	count *uint64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	atomic.AddUint64(body.count, uint64(n))
+	return n, err
+}
+
+// cacheStatsCache 缓存占用的上次结果
+type cacheStatsCache struct {
+	lock    sync.Mutex
+	stats   CacheStats
+	err     error
+	updated time.Time
+}
+
+func (c *cacheStatsCache) get(store CacheStore) (CacheStats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.updated) > cacheStatsTTL {
+		c.stats, c.err = store.Stats()
+		c.updated = time.Now()
+	}
+	return c.stats, c.err
+}
+
+// metricsWriter 按 Prometheus 文本格式输出
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w metricsWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (w metricsWriter) histogram(name, labels string, h *histogram) {
+	var cumulative uint64
+	for i, bucket := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		w.sample(name+"_bucket", labels+`,le="`+strconv.FormatFloat(bucket, 'g', -1, 64)+`"`, float64(cumulative))
+	}
+	count := atomic.LoadUint64(&h.count)
+	w.sample(name+"_bucket", labels+`,le="+Inf"`, float64(count))
+	w.sample(name+"_sum", labels, math.Float64frombits(atomic.LoadUint64(&h.sum)))
+	w.sample(name+"_count", labels, float64(count))
+}
+
+func domainLabel(domain string) string {
+	return `domain="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(domain) + `"`
+}
+
+// metrics Prometheus 抓取接口，只输出已配置站点的统计，删除的站点不再输出，避免标签无限增长
+func (admin *AdminModule) metrics(writer http.ResponseWriter, request *http.Request) {
+	app := admin.app
+	type siteItem struct {
+		domain  string
+		label   string
+		metrics *siteMetrics
+	}
+	items := make([]siteItem, 0)
+	sites := make(map[string]bool)
+	app.Sites.Range(func(key, value any) bool {
+		domain := key.(string)
+		sites[domain] = true
+		if metrics := value.(*Site).metrics; metrics != nil {
+			items = append(items, siteItem{domain, domainLabel(domain), metrics})
+		}
+		return true
+	})
+	sort.Slice(items, func(i, j int) bool { return items[i].domain < items[j].domain })
+	//删除的站点不再保留统计
+	app.metrics.Range(func(key, value any) bool {
+		if !sites[key.(string)] {
+			app.metrics.Delete(key)
+		}
+		return true
+	})
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := metricsWriter{bufio.NewWriter(writer)}
+	defer w.Flush()
+
+	w.header("mirror_sites", "gauge", "Number of configured sites.")
+	w.sample("mirror_sites", "", float64(len(sites)))
+
+	counter := func(name, help string, value func(*siteMetrics) uint64) {
+		w.header(name, "counter", help)
+		for _, item := range items {
+			w.sample(name, item.label, float64(value(item.metrics)))
+		}
+	}
+
+	w.header("mirror_requests_total", "counter", "Requests served per site by status class.")
+	for _, item := range items {
+		for i, class := range statusClasses {
+			w.sample("mirror_requests_total", item.label+`,code="`+class+`"`, float64(atomic.LoadUint64(&item.metrics.requests[i+1])))
+		}
+	}
+	w.header("mirror_cache_requests_total", "counter", "Cache lookups per site by result.")
+	for _, item := range items {
+		for i, result := range cacheResults {
+			w.sample("mirror_cache_requests_total", item.label+`,result="`+result+`"`, float64(atomic.LoadUint64(&item.metrics.cache[i])))
+		}
+	}
+	counter("mirror_origin_errors_total", "Origin requests that failed and went to the error handler.", func(m *siteMetrics) uint64 { return atomic.LoadUint64(&m.originError) })
+	counter("mirror_origin_received_bytes_total", "Response body bytes read from the origin.", func(m *siteMetrics) uint64 { return atomic.LoadUint64(&m.originBytes) })
+	counter("mirror_sent_bytes_total", "Response body bytes written to clients.", func(m *siteMetrics) uint64 { return atomic.LoadUint64(&m.sentBytes) })
+	w.header("mirror_origin_duration_seconds", "histogram", "Time until the origin returned response headers.")
+	for _, item := range items {
+		w.histogram("mirror_origin_duration_seconds", item.label, item.metrics.origin)
+	}
+	w.header("mirror_html_transform_duration_seconds", "histogram", "Time spent rewriting HTML pages.")
+	for _, item := range items {
+		w.histogram("mirror_html_transform_duration_seconds", item.label, item.metrics.render)
+	}
+
+	if store := app.CacheStore(); store != nil {
+		stats, err := admin.cacheUsage.get(store)
+		if err != nil {
+			app.Logger.Error("metrics cache stats error", err.Error())
+		}
+		label := `store="` + stats.Type + `"`
+		w.header("mirror_cache_bytes", "gauge", "Bytes used by the response cache.")
+		w.sample("mirror_cache_bytes", label, float64(stats.Bytes))
+		w.header("mirror_cache_entries", "gauge", "Entries in the response cache.")
+		w.sample("mirror_cache_entries", label, float64(stats.Entries))
+	}
+	if htmlCache := app.HtmlCache(); htmlCache != nil {
+		stats := htmlCache.Stats()
+		w.header("mirror_html_cache_bytes", "gauge", "Bytes used by the rendered HTML cache.")
+		w.sample("mirror_html_cache_bytes", "", float64(stats.Bytes))
+	}
+}
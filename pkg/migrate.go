@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migration 数据库结构变更，version 按顺序递增，已发布的迁移不能修改，只能追加新的。
+// 没有 schema_version 表的旧数据库会从头执行一遍，所以迁移要能在已有表和字段上重复执行
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// MigrationStatus 迁移状态，AppliedTime 为0表示未执行
+type MigrationStatus struct {
+	Version     int
+	Name        string
+	AppliedTime int64
+}
+
+var migrations = []migration{
+	{1, "create website_config", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`create table if not exists website_config  (
+		id integer primary key AUTOINCREMENT,
+		domain varchar(30) not null unique ,
+		url varchar(50),
+		index_title varchar(50),
+		index_keywords varchar(100),
+		index_description varchar(255),
+		finds varchar(100),
+		replaces varchar(100),
+		need_js boolean default false ,
+		s2t boolean default false ,
+		cache_enable boolean default true,
+		title_replace boolean default false ,
+		h1replace varchar(20),
+		cache_time integer,
+		baidu_push_key varchar(255),
+		sm_push_key varchar(255)
+)`)
+		return err
+	}},
+	{2, "website_config stale_time", func(tx *sql.Tx) error {
+		return addColumn(tx, "website_config", "stale_time", "integer default 0")
+	}},
+	{3, "create access_record", func(tx *sql.Tx) error {
+		return execAll(tx, `create table if not exists access_record (
+		id integer primary key AUTOINCREMENT,
+		domain varchar(100) not null,
+		path varchar(1024),
+		status integer default 0,
+		cache_hit boolean default false,
+		spider varchar(50),
+		user_agent varchar(512),
+		latency integer default 0,
+		created_time integer not null
+)`,
+			`create index if not exists idx_access_record_created_time on access_record(created_time)`,
+			`create index if not exists idx_access_record_domain on access_record(domain)`)
+	}},
+	{4, "access_record render_hit render_time", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "access_record", "render_hit", "boolean default false"); err != nil {
+			return err
+		}
+		return addColumn(tx, "access_record", "render_time", "integer default 0")
+	}},
+	{5, "create admin_user", func(tx *sql.Tx) error {
+		return execAll(tx, `create table if not exists admin_user (
+		id integer primary key AUTOINCREMENT,
+		user_name varchar(50) not null unique,
+		password_hash varchar(100) not null,
+		role varchar(20) not null default 'viewer',
+		created_time integer not null
+)`, `create table if not exists admin_user_domain (
+		user_id integer not null,
+		domain varchar(100) not null,
+		primary key(user_id, domain)
+)`)
+	}},
+	{6, "create audit_log", func(tx *sql.Tx) error {
+		return execAll(tx, `create table if not exists audit_log (
+		id integer primary key AUTOINCREMENT,
+		user_name varchar(50) not null default '',
+		action varchar(30) not null,
+		domain varchar(100) not null default '',
+		before_json text not null default '',
+		after_json text not null default '',
+		ip varchar(64) not null default '',
+		created_time integer not null
+)`,
+			`create index if not exists idx_audit_log_created_time on audit_log(created_time)`,
+			`create index if not exists idx_audit_log_domain on audit_log(domain)`)
+	}},
+	{7, "create api_token", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`create table if not exists api_token (
+		id integer primary key AUTOINCREMENT,
+		user_id integer not null,
+		name varchar(50) not null default '',
+		token_hash varchar(64) not null unique,
+		created_time integer not null,
+		last_used_time integer not null default 0
+)`)
+		return err
+	}},
+	{8, "create replace_rules", migrateReplaceRules},
+	{9, "replace_rules selector attrs paths", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "replace_rules", "selector", "text not null default ''"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "replace_rules", "attrs", "varchar(255) not null default ''"); err != nil {
+			return err
+		}
+		return addColumn(tx, "replace_rules", "paths", "text not null default ''")
+	}},
+	{10, "create header_rules", func(tx *sql.Tx) error {
+		return execAll(tx, `create table if not exists header_rules (
+		id integer primary key AUTOINCREMENT,
+		site_id integer not null,
+		sort integer not null default 0,
+		action varchar(10) not null,
+		name varchar(100) not null,
+		value text not null default '',
+		paths text not null default '',
+		content_types varchar(255) not null default '',
+		enabled boolean not null default true
+)`, `create index if not exists idx_header_rules_site_id on header_rules(site_id, sort)`)
+	}},
+	{11, "website_config upstream", func(tx *sql.Tx) error {
+		return addColumn(tx, "website_config", "upstream", "text not null default ''")
+	}},
+}
+
+// migrateReplaceRules 建 replace_rules 表，把 website_config 里 ; 分隔的 finds、replaces 转成普通替换规则，
+// 原来的字段保留不再使用
+func migrateReplaceRules(tx *sql.Tx) error {
+	err := execAll(tx, `create table if not exists replace_rules (
+		id integer primary key AUTOINCREMENT,
+		site_id integer not null,
+		sort integer not null default 0,
+		find text not null,
+		replacement text not null default '',
+		match_type varchar(20) not null default 'literal',
+		scope varchar(50) not null default 'text,attr,asset',
+		enabled boolean not null default true
+)`, `create index if not exists idx_replace_rules_site_id on replace_rules(site_id, sort)`)
+	if err != nil {
+		return err
+	}
+	rs, err := tx.Query(`select id,ifnull(finds,''),ifnull(replaces,'') from website_config
+		where id not in (select distinct site_id from replace_rules)`)
+	if err != nil {
+		return err
+	}
+	sites := make(map[int][]ReplaceRule)
+	for rs.Next() {
+		var id int
+		var finds, replaces string
+		if err = rs.Scan(&id, &finds, &replaces); err != nil {
+			_ = rs.Close()
+			return err
+		}
+		sites[id] = legacyRules(strings.Split(finds, ";"), strings.Split(replaces, ";"))
+	}
+	_ = rs.Close()
+	//不能用 saveRules，后面的迁移会给表加字段
+	insertSql := "insert into replace_rules(site_id,sort,find,replacement,match_type,scope,enabled)values (?,?,?,?,?,?,?)"
+	for id, rules := range sites {
+		for i, rule := range rules {
+			if _, err = tx.Exec(insertSql, id, i, rule.Find, rule.Replace, rule.MatchType, strings.Join(rule.Scopes, ","), rule.Enabled); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// InitTable 启动时执行未执行的迁移，已有数据的数据库迁移前先备份
+func InitTable() error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = createVersionTable(db); err != nil {
+		return err
+	}
+	status, err := migrationStatus(db)
+	if err != nil {
+		return err
+	}
+	pending := make([]migration, 0)
+	for i, item := range migrations {
+		if status[i].AppliedTime == 0 {
+			pending = append(pending, item)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if err = backupBeforeMigrate(db); err != nil {
+		return fmt.Errorf("迁移前备份数据库失败: %w", err)
+	}
+	for _, item := range pending {
+		if err = runMigration(db, item); err != nil {
+			return fmt.Errorf("数据库迁移 %d %s 失败: %w", item.version, item.name, err)
+		}
+	}
+	return nil
+}
+
+// GetMigrationStatus 返回所有迁移的执行状态，数据库里有程序不认识的版本时也一起返回
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err = createVersionTable(db); err != nil {
+		return nil, err
+	}
+	return migrationStatus(db)
+}
+
+func createVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists schema_version (
+		version integer primary key,
+		name varchar(100) not null,
+		applied_time integer not null
+)`)
+	return err
+}
+
+func migrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	rs, err := db.Query("select version,name,applied_time from schema_version order by version")
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	applied := make(map[int]MigrationStatus)
+	for rs.Next() {
+		var item MigrationStatus
+		if err = rs.Scan(&item.Version, &item.Name, &item.AppliedTime); err != nil {
+			return nil, err
+		}
+		applied[item.Version] = item
+	}
+	if err = rs.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]MigrationStatus, 0, len(migrations))
+	for _, item := range migrations {
+		results = append(results, MigrationStatus{Version: item.version, Name: item.name, AppliedTime: applied[item.version].AppliedTime})
+		delete(applied, item.version)
+	}
+	unknown := make([]MigrationStatus, 0, len(applied))
+	for _, item := range applied {
+		unknown = append(unknown, item)
+	}
+	sort.Slice(unknown, func(i, j int) bool {
+		return unknown[i].Version < unknown[j].Version
+	})
+	return append(results, unknown...), nil
+}
+
+// runMigration 迁移和版本记录在同一个事务里，失败时整体回滚
+func runMigration(db *sql.DB, item migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = item.up(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("insert into schema_version(version,name,applied_time)values (?,?,?)", item.version, item.name, time.Now().Unix())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// backupBeforeMigrate 新建的空数据库不需要备份
+func backupBeforeMigrate(db *sql.DB) error {
+	var count int
+	err := db.QueryRow(`select count(*) from sqlite_master where type='table' and name not like 'sqlite_%' and name!='schema_version'`).Scan(&count)
+	if err != nil || count == 0 {
+		return err
+	}
+	backupPath := fmt.Sprintf("%s.%s.bak", dbPath, time.Now().Format("20060102150405"))
+	//VACUUM INTO 生成一致的副本，不受正在写入的影响
+	_, err = db.Exec("vacuum into '" + strings.ReplaceAll(backupPath, "'", "''") + "'")
+	return err
+}
+
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func execAll(db sqlExecutor, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn 字段已存在时跳过，兼容没有版本记录的旧数据库
+func addColumn(db sqlExecutor, table, column, definition string) error {
+	rs, err := db.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	exists := false
+	for rs.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err = rs.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			_ = rs.Close()
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			exists = true
+		}
+	}
+	_ = rs.Close()
+	if exists {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempDb 切换到临时目录，dbPath 是相对路径
+func useTempDb(t *testing.T) *sql.DB {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableColumns(t *testing.T, db *sql.DB, table string) map[string]bool {
+	t.Helper()
+	rs, err := db.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	columns := make(map[string]bool)
+	for rs.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err = rs.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			t.Fatal(err)
+		}
+		columns[name] = true
+	}
+	return columns
+}
+
+func backupFiles(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob(dbPath + ".*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func checkMigrated(t *testing.T) {
+	t.Helper()
+	status, err := GetMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("status has %d items, want %d", len(status), len(migrations))
+	}
+	for i, item := range status {
+		if item.Version != migrations[i].version || item.AppliedTime == 0 {
+			t.Fatalf("migration %d %s not applied", item.Version, item.Name)
+		}
+	}
+}
+
+func TestInitTableFreshDb(t *testing.T) {
+	db := useTempDb(t)
+	if err := InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t)
+	for table, columns := range map[string][]string{
+		"website_config": {"stale_time", "upstream"},
+		"access_record":  {"render_hit", "render_time"},
+		"replace_rules":  {"match_type", "scope", "enabled"},
+		"header_rules":   {"content_types"},
+		"admin_user":     {"role"},
+		"audit_log":      {"before_json"},
+		"api_token":      {"token_hash"},
+	} {
+		exists := tableColumns(t, db, table)
+		for _, column := range columns {
+			if !exists[column] {
+				t.Errorf("%s.%s missing", table, column)
+			}
+		}
+	}
+	//新建的空数据库不备份
+	if files := backupFiles(t); len(files) != 0 {
+		t.Fatalf("fresh db should not be backed up: %v", files)
+	}
+
+	//再次启动没有需要执行的迁移
+	if err := InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t)
+}
+
+func TestInitTableLegacyDb(t *testing.T) {
+	db := useTempDb(t)
+	//没有 schema_version 的旧数据库，已经手动加过 stale_time
+	err := execAll(db, `create table website_config (
+		id integer primary key AUTOINCREMENT,
+		domain varchar(30) not null unique,
+		url varchar(50),
+		finds varchar(100),
+		replaces varchar(100),
+		stale_time integer default 0
+)`, `insert into website_config(domain,url,finds,replaces)values ('example.com','http://origin.example.com','a;b;','x;y;')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t)
+	if files := backupFiles(t); len(files) != 1 {
+		t.Fatalf("want one backup before migrating, got %v", files)
+	}
+
+	var finds, replaces string
+	if err = db.QueryRow("select finds,replaces from website_config where domain='example.com'").Scan(&finds, &replaces); err != nil {
+		t.Fatal(err)
+	}
+	if finds != "a;b;" || replaces != "x;y;" {
+		t.Fatalf("legacy data changed: %q %q", finds, replaces)
+	}
+	if !tableColumns(t, db, "access_record")["render_time"] {
+		t.Fatal("access_record should be created")
+	}
+
+	rs, err := db.Query("select find,replacement,match_type,enabled from replace_rules order by sort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	var rules []ReplaceRule
+	for rs.Next() {
+		var rule ReplaceRule
+		if err = rs.Scan(&rule.Find, &rule.Replace, &rule.MatchType, &rule.Enabled); err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) != 2 || rules[0].Find != "a" || rules[0].Replace != "x" || rules[1].Find != "b" || rules[1].Replace != "y" {
+		t.Fatalf("legacy finds/replaces not migrated: %+v", rules)
+	}
+	if rules[0].MatchType != MatchLiteral || !rules[0].Enabled {
+		t.Fatalf("migrated rule should be an enabled literal rule: %+v", rules[0])
+	}
+}
+
+func TestMigrationVersionsIncrease(t *testing.T) {
+	for i, item := range migrations {
+		if item.version != i+1 {
+			t.Fatalf("migration %s has version %d, want %d", item.name, item.version, i+1)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"net/http"
+	"time"
+)
+
+type AccessRecord struct {
+	Id          int64  `json:"id"`
+	Domain      string `json:"domain"`
+	Path        string `json:"path"`
+	Status      int    `json:"status"`
+	CacheHit    bool   `json:"cache_hit"`
+	Spider      string `json:"spider"`
+	UserAgent   string `json:"user_agent"`
+	Latency     int64  `json:"latency"`
+	RenderHit   bool   `json:"render_hit"`  //命中替换后的html缓存
+	RenderTime  int64  `json:"render_time"` //解析替换html的耗时，微秒，单个请求的CPU消耗主要在这里
+	CreatedTime int64  `json:"created_time"`
+}
+
+// recordWriter 记录响应状态码和写出的字节数
+type recordWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	written     int64
+}
+
+func (w *recordWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.status = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.status = http.StatusOK
+		w.wroteHeader = true
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *recordWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *recordWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func markCacheHit(request *http.Request) {
+	if record, ok := request.Context().Value(ACCESS_RECORD).(*AccessRecord); ok {
+		record.CacheHit = true
+	}
+}
+
+func markRenderHit(request *http.Request) {
+	if record, ok := request.Context().Value(ACCESS_RECORD).(*AccessRecord); ok {
+		record.RenderHit = true
+	}
+}
+
+func addRenderTime(request *http.Request, duration time.Duration) {
+	if record, ok := request.Context().Value(ACCESS_RECORD).(*AccessRecord); ok {
+		record.RenderTime += duration.Microseconds()
+	}
+}
+
+// RecordStat 按域名汇总的访问统计，时间单位同 AccessRecord
+type RecordStat struct {
+	Domain      string  `json:"domain"`
+	Count       int64   `json:"count"`
+	CacheHits   int64   `json:"cache_hits"`
+	RenderHits  int64   `json:"render_hits"`
+	AvgLatency  float64 `json:"avg_latency"`
+	MaxLatency  int64   `json:"max_latency"`
+	AvgRender   float64 `json:"avg_render"`
+	TotalRender int64   `json:"total_render"`
+}
+
+func (app *Application) addRecord(record *AccessRecord) {
+	app.recordLock.RLock()
+	defer app.recordLock.RUnlock()
+	if app.records == nil {
+		return
+	}
+	select {
+	case app.records <- record:
+	default:
+		//队列已满，丢弃
+	}
+}
+
+// recordLoop 批量写入访问记录，避免每个请求都写一次数据库
+func (app *Application) recordLoop() {
+	defer close(app.recordDone)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := make([]*AccessRecord, 0, 200)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := app.Dao.AddRecords(batch); err != nil {
+			app.Logger.Error("AddRecords error", err.Error())
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case record, ok := <-app.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= 200 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (app *Application) stopRecord() {
+	app.recordLock.Lock()
+	if app.records == nil {
+		app.recordLock.Unlock()
+		return
+	}
+	close(app.records)
+	app.records = nil
+	app.recordLock.Unlock()
+	<-app.recordDone
+}
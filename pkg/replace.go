@@ -0,0 +1,459 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	keywordRegexp     = regexp.MustCompile(`\{\{keyword:(\d+)\}\}`)
+	chineseRegexp     = regexp.MustCompile("^[\u4e00-\u9fa5]+")
+	encodedPathRegexp = regexp.MustCompile(`^/([a-f\d]{5}_)`)
+	//$1块 在 go 里会被当成名为 1块 的分组，改成 ${1}块
+	groupRefRegexp = regexp.MustCompile(`\$(\$|\d+)`)
+)
+
+const (
+	MatchLiteral    = "literal"
+	MatchRegex      = "regex"
+	MatchIgnoreCase = "ignore_case"
+
+	ScopeText  = "text"  //html 文本
+	ScopeAttr  = "attr"  //html 的 title、alt 等属性
+	ScopeAsset = "asset" //css、js
+	ScopeBody  = "body"  //解析前的整个html
+
+	maxReplaceRules = 1000
+)
+
+var (
+	matchTypes = map[string]bool{MatchLiteral: true, MatchRegex: true, MatchIgnoreCase: true}
+	ruleScopes = map[string]bool{ScopeText: true, ScopeAttr: true, ScopeAsset: true, ScopeBody: true}
+	//原来 finds/replaces 的替换范围
+	defaultScopes = []string{ScopeText, ScopeAttr, ScopeAsset}
+	//没有指定 attrs 时替换的属性
+	defaultAttrs = map[string]bool{"title": true, "alt": true, "value": true, "placeholder": true, "content": true}
+)
+
+// ReplaceRule 站点的替换规则，按在 SiteConfig.Rules 中的顺序执行
+type ReplaceRule struct {
+	Id        int      `json:"-"`
+	SiteId    int      `json:"-"`
+	Sort      int      `json:"-"`
+	Find      string   `json:"find"`
+	Replace   string   `json:"replace"`
+	MatchType string   `json:"match_type"`
+	Scopes    []string `json:"scopes"`
+	//CSS选择器，只替换匹配的元素里的文本和属性
+	Selector string `json:"selector,omitempty"`
+	//attr 范围替换的属性，为空时为 title、alt、value、placeholder、content
+	Attrs []string `json:"attrs,omitempty"`
+	//页面路径，* 匹配任意字符，为空时不限制
+	Paths   []string `json:"paths,omitempty"`
+	Enabled bool     `json:"enabled"`
+}
+
+// UnmarshalJSON 没有 enabled 字段时默认启用，未知字段报错
+func (rule *ReplaceRule) UnmarshalJSON(data []byte) error {
+	type plainRule ReplaceRule
+	item := plainRule{Enabled: true}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&item); err != nil {
+		return err
+	}
+	*rule = ReplaceRule(item)
+	return nil
+}
+
+func (rule *ReplaceRule) hasScope(scope string) bool {
+	for _, item := range rule.Scopes {
+		if item == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// regexp 正则和忽略大小写的规则编译成正则
+func (rule *ReplaceRule) regexp() (*regexp.Regexp, error) {
+	switch rule.MatchType {
+	case MatchRegex:
+		return regexp.Compile(rule.Find)
+	case MatchIgnoreCase:
+		return regexp.Compile("(?i)" + regexp.QuoteMeta(rule.Find))
+	}
+	return nil, nil
+}
+
+// validateRules 检查替换规则，match_type 为空时按 literal，scopes 为空时按原来的替换范围
+func validateRules(rules []ReplaceRule) error {
+	if len(rules) > maxReplaceRules {
+		return fmt.Errorf("替换规则不能超过%d条", maxReplaceRules)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Find == "" {
+			return fmt.Errorf("第%d条替换规则的查找内容不能为空", i+1)
+		}
+		if rule.MatchType == "" {
+			rule.MatchType = MatchLiteral
+		}
+		if !matchTypes[rule.MatchType] {
+			return fmt.Errorf("第%d条替换规则的匹配方式 %s 错误", i+1, rule.MatchType)
+		}
+		if len(rule.Scopes) == 0 {
+			rule.Scopes = append([]string{}, defaultScopes...)
+		}
+		for _, scope := range rule.Scopes {
+			if !ruleScopes[scope] {
+				return fmt.Errorf("第%d条替换规则的范围 %s 错误", i+1, scope)
+			}
+		}
+		re, err := rule.regexp()
+		if err != nil {
+			return fmt.Errorf("第%d条替换规则的正则错误: %w", i+1, err)
+		}
+		if re != nil && re.MatchString("") {
+			return fmt.Errorf("第%d条替换规则的正则不能匹配空字符串", i+1)
+		}
+		if err = validateRuleCondition(rule); err != nil {
+			return fmt.Errorf("第%d条替换规则%w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateRuleCondition 选择器和属性只能用于html的文本和属性，属性名转成小写
+func validateRuleCondition(rule *ReplaceRule) error {
+	rule.Selector = strings.TrimSpace(rule.Selector)
+	if rule.Selector != "" || len(rule.Attrs) > 0 {
+		for _, scope := range rule.Scopes {
+			if scope != ScopeText && scope != ScopeAttr {
+				return fmt.Errorf("的选择器和属性只能用于 text、attr 范围")
+			}
+		}
+	}
+	if rule.Selector != "" {
+		if _, err := parseSelector(rule.Selector); err != nil {
+			return fmt.Errorf("的%w", err)
+		}
+	}
+	if len(rule.Attrs) > 0 && !rule.hasScope(ScopeAttr) {
+		return fmt.Errorf("指定了属性，范围需要包含 attr")
+	}
+	for i, attr := range rule.Attrs {
+		attr = strings.ToLower(strings.TrimSpace(attr))
+		if attr == "" || strings.ContainsAny(attr, " ,=\"'<>/") {
+			return fmt.Errorf("的属性名 %s 错误", rule.Attrs[i])
+		}
+		rule.Attrs[i] = attr
+	}
+	if err := validatePaths(rule.Paths); err != nil {
+		return fmt.Errorf("的%w", err)
+	}
+	return nil
+}
+
+// validatePaths 路径模式以 / 或 * 开头，数据库里用换行分隔，不能有空白
+func validatePaths(paths []string) error {
+	for _, item := range paths {
+		if !strings.HasPrefix(item, "/") && !strings.HasPrefix(item, "*") {
+			return fmt.Errorf("路径 %s 需要以 / 或 * 开头", item)
+		}
+		if strings.ContainsAny(item, " \t\r\n") {
+			return fmt.Errorf("路径 %s 不能包含空白", item)
+		}
+	}
+	return nil
+}
+
+// globRegexp 把路径、内容类型等模式转成正则，* 匹配任意字符，没有模式时返回nil
+func globRegexp(globs []string) *regexp.Regexp {
+	if len(globs) == 0 {
+		return nil
+	}
+	patterns := make([]string, 0, len(globs))
+	for _, item := range globs {
+		patterns = append(patterns, strings.ReplaceAll(regexp.QuoteMeta(item), `\*`, ".*"))
+	}
+	return regexp.MustCompile("^(?:" + strings.Join(patterns, "|") + ")$")
+}
+
+// legacyRules 把原来 ; 分隔的 finds/replaces 转成替换规则，replaces 不够时跳过，和原来的替换逻辑一致
+func legacyRules(finds, replaces []string) []ReplaceRule {
+	rules := make([]ReplaceRule, 0, len(finds))
+	for index, find := range finds {
+		if find == "" || index >= len(replaces) {
+			continue
+		}
+		rules = append(rules, ReplaceRule{
+			Find:      find,
+			Replace:   replaces[index],
+			MatchType: MatchLiteral,
+			Scopes:    append([]string{}, defaultScopes...),
+			Enabled:   true,
+		})
+	}
+	return rules
+}
+
+// replaceTarget 替换的位置，node 是文本节点或者属性所在的元素，attr 是小写的属性名
+type replaceTarget struct {
+	path string
+	node *html.Node
+	attr string
+}
+
+// ruleCondition 规则的选择器、属性和路径限制
+type ruleCondition struct {
+	selector cssSelector
+	attrs    map[string]bool
+	paths    *regexp.Regexp
+}
+
+func newRuleCondition(rule *ReplaceRule) *ruleCondition {
+	if rule.Selector == "" && len(rule.Attrs) == 0 && len(rule.Paths) == 0 {
+		return nil
+	}
+	cond := &ruleCondition{paths: globRegexp(rule.Paths)}
+	if rule.Selector != "" {
+		cond.selector, _ = parseSelector(rule.Selector)
+	}
+	if len(rule.Attrs) > 0 {
+		cond.attrs = make(map[string]bool)
+		for _, attr := range rule.Attrs {
+			cond.attrs[attr] = true
+		}
+	}
+	return cond
+}
+
+// match 没有指定属性的规则只替换 defaultAttrs
+func (cond *ruleCondition) match(target replaceTarget) bool {
+	attrs := defaultAttrs
+	if cond != nil && cond.attrs != nil {
+		attrs = cond.attrs
+	}
+	if target.attr != "" && !attrs[target.attr] {
+		return false
+	}
+	if cond == nil {
+		return true
+	}
+	if cond.paths != nil && !cond.paths.MatchString(target.path) {
+		return false
+	}
+	return cond.selector == nil || cond.selector.matchWithin(target.node)
+}
+
+// replaceStep 连续的没有限制条件的普通替换合并成一个 strings.Replacer，一次遍历完成；其他规则每条一步
+type replaceStep struct {
+	replacer *strings.Replacer
+	re       *regexp.Regexp
+	repl     string
+	//替换内容里有 $1 之类的分组引用
+	expand bool
+	cond   *ruleCondition
+	//不用 ruleMarker 的替换，用于 href、src 等 defaultAttrs 以外的属性，这些属性后面还会当成链接处理
+	plain *replaceStep
+}
+
+// replacePipeline 按规则顺序执行的替换
+type replacePipeline []replaceStep
+
+func (pipeline replacePipeline) Replace(s string, target replaceTarget) string {
+	for _, step := range pipeline {
+		if !step.cond.match(target) {
+			continue
+		}
+		if step.plain != nil && target.attr != "" && !defaultAttrs[target.attr] {
+			step = *step.plain
+		}
+		switch {
+		case step.replacer != nil:
+			s = step.replacer.Replace(s)
+		case step.expand:
+			s = step.re.ReplaceAllString(s, step.repl)
+		default:
+			s = step.re.ReplaceAllLiteralString(s, step.repl)
+		}
+	}
+	return s
+}
+
+// ruleMarker html文本和属性里先替换成私有区字符，html.Render 之后再换成替换词，避免替换词里的实体被转义。
+// 用补充私有区，避免和图标字体常用的 U+E000 区冲突
+func ruleMarker(index int) string {
+	return string(rune(0xF0000 + index))
+}
+
+// buildPipeline 生成某个范围的替换，marker 为 true 时固定的替换内容用 ruleMarker 占位
+func buildPipeline(rules []ReplaceRule, scope string, marker bool) replacePipeline {
+	pipeline := make(replacePipeline, 0)
+	pairs := make([]string, 0)
+	flush := func() {
+		if len(pairs) > 0 {
+			pipeline = append(pipeline, replaceStep{replacer: strings.NewReplacer(pairs...)})
+			pairs = make([]string, 0)
+		}
+	}
+	for index, rule := range rules {
+		if !rule.Enabled || rule.Find == "" || !rule.hasScope(scope) {
+			continue
+		}
+		replace := HtmlEntities(rule.Replace)
+		if marker {
+			replace = ruleMarker(index)
+		}
+		re, err := rule.regexp()
+		if err != nil {
+			continue
+		}
+		cond := newRuleCondition(&rules[index])
+		if re == nil && cond == nil {
+			pairs = append(pairs, rule.Find, replace)
+			continue
+		}
+		flush()
+		if re == nil {
+			step := replaceStep{replacer: strings.NewReplacer(rule.Find, replace), cond: cond}
+			if marker && len(rule.Attrs) > 0 {
+				step.plain = &replaceStep{replacer: strings.NewReplacer(rule.Find, rule.Replace)}
+			}
+			pipeline = append(pipeline, step)
+			continue
+		}
+		step := replaceStep{re: re, repl: replace, cond: cond}
+		if marker && len(rule.Attrs) > 0 {
+			step.plain = &replaceStep{re: re, repl: rule.Replace}
+		}
+		if rule.MatchType == MatchRegex && strings.Contains(rule.Replace, "$") {
+			//分组引用的结果不固定，不能占位，直接替换成文本
+			step.expand = true
+			step.repl = groupRefRegexp.ReplaceAllStringFunc(rule.Replace, func(ref string) string {
+				if ref == "$$" {
+					return ref
+				}
+				return "${" + ref[1:] + "}"
+			})
+			if !marker {
+				step.repl = HtmlEntities(step.repl)
+			}
+			step.plain = nil
+		}
+		pipeline = append(pipeline, step)
+	}
+	flush()
+	return pipeline
+}
+
+// siteReplacer 创建站点时预先生成的替换器
+type siteReplacer struct {
+	text  replacePipeline
+	attr  replacePipeline
+	asset replacePipeline
+	body  replacePipeline
+	//把 ruleMarker 换成替换词
+	tag *strings.Replacer
+	//需要替换的属性，defaultAttrs 加上规则指定的属性
+	attrNames map[string]bool
+
+	//所有源站的 host，长的在前面，避免先替换了其中一部分
+	originHosts []string
+	//源站主域名，源站是子域名时去掉第一段
+	originDomains   []string
+	subDomainRegexp *regexp.Regexp
+}
+
+// newSiteReplacer rules 为站点规则加上全局替换，已经过 validateRules 检查，origins 是站点的所有源站
+func newSiteReplacer(rules []ReplaceRule, origins []*url.URL) *siteReplacer {
+	tagPairs := make([]string, 0, len(rules)*2)
+	attrNames := make(map[string]bool)
+	for name := range defaultAttrs {
+		attrNames[name] = true
+	}
+	for index, rule := range rules {
+		if rule.Enabled && (rule.hasScope(ScopeText) || rule.hasScope(ScopeAttr)) {
+			tagPairs = append(tagPairs, ruleMarker(index), HtmlEntities(rule.Replace))
+		}
+		if rule.Enabled && rule.hasScope(ScopeAttr) {
+			for _, name := range rule.Attrs {
+				attrNames[name] = true
+			}
+		}
+	}
+	originHosts := make([]string, 0, len(origins))
+	originDomains := make([]string, 0, len(origins))
+	seenHosts := make(map[string]bool)
+	seenDomains := make(map[string]bool)
+	for _, u := range origins {
+		if !seenHosts[u.Host] {
+			originHosts = append(originHosts, u.Host)
+		}
+		seenHosts[u.Host] = true
+		originDomain := u.Host
+		hostParts := strings.Split(u.Host, ".")
+		if len(hostParts) >= 3 {
+			originDomain = strings.Join(hostParts[1:], ".")
+		}
+		if !seenDomains[originDomain] {
+			originDomains = append(originDomains, originDomain)
+		}
+		seenDomains[originDomain] = true
+	}
+	sort.SliceStable(originHosts, func(i, j int) bool { return len(originHosts[i]) > len(originHosts[j]) })
+	sort.SliceStable(originDomains, func(i, j int) bool { return len(originDomains[i]) > len(originDomains[j]) })
+	quoted := make([]string, 0, len(originDomains))
+	for _, originDomain := range originDomains {
+		quoted = append(quoted, regexp.QuoteMeta(originDomain))
+	}
+	return &siteReplacer{
+		text:            buildPipeline(rules, ScopeText, true),
+		attr:            buildPipeline(rules, ScopeAttr, true),
+		asset:           buildPipeline(rules, ScopeAsset, false),
+		body:            buildPipeline(rules, ScopeBody, false),
+		tag:             strings.NewReplacer(tagPairs...),
+		attrNames:       attrNames,
+		originHosts:     originHosts,
+		originDomains:   originDomains,
+		subDomainRegexp: regexp.MustCompile(`[a-zA-Z0-9]+\.(?:` + strings.Join(quoted, "|") + `)`),
+	}
+}
+
+// isOriginHost host 是否是站点的某个源站
+func (replacer *siteReplacer) isOriginHost(host string) bool {
+	for _, originHost := range replacer.originHosts {
+		if strings.EqualFold(host, originHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteRules 站点启用的规则加上全局替换，不修改 siteConfig
+func siteRules(siteConfig *SiteConfig, appConfig *AppConfig) []ReplaceRule {
+	rules := make([]ReplaceRule, 0, len(siteConfig.Rules)+len(appConfig.GlobalReplace))
+	for _, rule := range siteConfig.Rules {
+		if rule.Enabled {
+			rules = append(rules, rule)
+		}
+	}
+	for _, item := range appConfig.GlobalReplace {
+		rules = append(rules, ReplaceRule{
+			Find:      item["needle"],
+			Replace:   item["replace"],
+			MatchType: MatchLiteral,
+			Scopes:    defaultScopes,
+			Enabled:   true,
+		})
+	}
+	return rules
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const benchOrigin = "https://www.origin-example.com"
+
+// benchRules 200条普通替换，和 muban 表格里常见的规模相当
+func benchRules() ([]string, []string) {
+	finds := make([]string, 0, 200)
+	replaces := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		finds = append(finds, fmt.Sprintf("keyword%03d", i))
+		replaces = append(replaces, fmt.Sprintf("replaced%03d", i))
+	}
+	return finds, replaces
+}
+
+// benchPage 大约100KB的页面，包含替换词、源站链接和普通文本
+func benchPage() string {
+	var builder strings.Builder
+	builder.WriteString("<html><head><title>keyword001 标题</title></head><body>")
+	for i := 0; builder.Len() < 100*1024; i++ {
+		fmt.Fprintf(&builder, `<div class="item"><a href="%s/news/%d.html">keyword%03d 新闻 %d</a>`, benchOrigin, i, i%250, i)
+		fmt.Fprintf(&builder, `<p>这是一段普通的正文内容 keyword%03d，访问 https://img.origin-example.com/%d.jpg 查看</p></div>`, (i*7)%250, i)
+	}
+	builder.WriteString("</body></html>")
+	return builder.String()
+}
+
+// legacyReplace 原来的做法：每个替换词遍历一次页面，再用正则还原占位符，每次都编译正则
+func legacyReplace(content string, finds, replaces []string, origin string, domain string, requestHost string) string {
+	for index, find := range finds {
+		tag := fmt.Sprintf("{{replace:%d}}", index)
+		content = strings.ReplaceAll(content, find, tag)
+	}
+	replaceRegexp, _ := regexp.Compile(`\{\{replace:(\d+)\}\}`)
+	replaceTags := replaceRegexp.FindAllStringSubmatch(content, -1)
+	for _, replaceTag := range replaceTags {
+		index, err := strconv.Atoi(replaceTag[1])
+		if err != nil {
+			continue
+		}
+		content = strings.ReplaceAll(content, replaceTag[0], replaces[index])
+	}
+	u, _ := url.Parse(origin)
+	content = strings.ReplaceAll(content, u.Host, requestHost)
+	content = strings.ReplaceAll(content, "https://"+requestHost, "http://"+requestHost)
+	originHost := u.Host
+	hostParts := strings.Split(u.Host, ".")
+	if len(hostParts) >= 3 {
+		originHost = strings.Join(hostParts[1:], ".")
+	}
+	subDomainRegexp, _ := regexp.Compile(`[a-zA-Z0-9]+\.` + originHost)
+	content = subDomainRegexp.ReplaceAllString(content, "")
+	content = strings.ReplaceAll(content, originHost, domain)
+	return content
+}
+
+func newBenchSite() *Site {
+	finds, replaces := benchRules()
+	u, _ := url.Parse(benchOrigin)
+	return &Site{
+		SiteConfig:   &SiteConfig{Domain: "example.com"},
+		siteReplacer: newSiteReplacer(legacyRules(finds, replaces), []*url.URL{u}),
+	}
+}
+
+func pipelineReplace(site *Site, content string, requestHost string) string {
+	content = site.text.Replace(content, replaceTarget{path: "/"})
+	content = site.tag.Replace(content)
+	return site.replaceHost(content, requestHost)
+}
+
+func TestSiteReplacerMatchesLegacy(t *testing.T) {
+	finds, replaces := benchRules()
+	page := benchPage()
+	want := legacyReplace(page, finds, replaces, benchOrigin, "example.com", "www.example.com")
+	if got := pipelineReplace(newBenchSite(), page, "www.example.com"); got != want {
+		t.Fatal("pipeline result differs from the per-rule replacement")
+	}
+}
+
+func BenchmarkSiteReplacerLegacy(b *testing.B) {
+	finds, replaces := benchRules()
+	page := benchPage()
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		legacyReplace(page, finds, replaces, benchOrigin, "example.com", "www.example.com")
+	}
+}
+
+func BenchmarkSiteReplacerPipeline(b *testing.B) {
+	site := newBenchSite()
+	page := benchPage()
+	b.SetBytes(int64(len(page)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pipelineReplace(site, page, "www.example.com")
+	}
+}
+
+func BenchmarkSiteReplacerNewSite(b *testing.B) {
+	finds, replaces := benchRules()
+	rules := legacyRules(finds, replaces)
+	u, _ := url.Parse(benchOrigin)
+	for i := 0; i < b.N; i++ {
+		newSiteReplacer(rules, []*url.URL{u})
+	}
+}
@@ -0,0 +1,310 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// cssSelector 替换规则用的简单CSS选择器，支持标签、*、#id、.class、[attr]、[attr=v]、[attr~=v]、[attr^=v]、[attr$=v]、[attr*=v]，
+// 后代(空格)和子元素(>)组合，多个选择器用 , 分隔，不支持伪类
+type cssSelector [][]selectorPart
+
+// selectorPart combinator 是和前一部分的关系，第一部分为0
+type selectorPart struct {
+	combinator byte
+	tag        string
+	id         string
+	classes    []string
+	attrs      []attrSelector
+}
+
+type attrSelector struct {
+	key string
+	op  string
+	val string
+}
+
+func parseSelector(s string) (cssSelector, error) {
+	selector := make(cssSelector, 0)
+	for _, item := range splitSelector(s) {
+		parts, err := parseComplexSelector(item)
+		if err != nil {
+			return nil, fmt.Errorf("选择器 %s 错误: %w", strings.TrimSpace(item), err)
+		}
+		selector = append(selector, parts)
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("选择器不能为空")
+	}
+	return selector, nil
+}
+
+// splitSelector 按 , 分隔，[] 和引号里的 , 不分隔
+func splitSelector(s string) []string {
+	items := make([]string, 0)
+	depth := 0
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+func isSelectorSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c >= 0x80
+}
+
+func readIdent(s string, i int) (string, int) {
+	start := i
+	for i < len(s) && isIdentChar(s[i]) {
+		i++
+	}
+	return s[start:i], i
+}
+
+func parseComplexSelector(s string) ([]selectorPart, error) {
+	parts := make([]selectorPart, 0)
+	i := 0
+	for {
+		spaced := false
+		for i < len(s) && isSelectorSpace(s[i]) {
+			i++
+			spaced = true
+		}
+		if i >= len(s) {
+			break
+		}
+		var combinator byte
+		if len(parts) > 0 {
+			if spaced {
+				combinator = ' '
+			}
+			if s[i] == '>' {
+				combinator = '>'
+				i++
+				for i < len(s) && isSelectorSpace(s[i]) {
+					i++
+				}
+			}
+			if combinator == 0 {
+				return nil, fmt.Errorf("位置%d不支持的字符 %c", i+1, s[i])
+			}
+		}
+		part := selectorPart{combinator: combinator}
+		var err error
+		i, err = parseCompound(s, i, &part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("选择器为空")
+	}
+	return parts, nil
+}
+
+// parseCompound 读取没有空格的一段，比如 div.item[data-id]
+func parseCompound(s string, i int, part *selectorPart) (int, error) {
+	start := i
+	if i < len(s) && s[i] == '*' {
+		i++
+	} else {
+		part.tag, i = readIdent(s, i)
+		part.tag = strings.ToLower(part.tag)
+	}
+	for i < len(s) && !isSelectorSpace(s[i]) && s[i] != '>' {
+		var name string
+		switch s[i] {
+		case '#':
+			name, i = readIdent(s, i+1)
+			if name == "" {
+				return i, fmt.Errorf("# 后面缺少id")
+			}
+			part.id = name
+		case '.':
+			name, i = readIdent(s, i+1)
+			if name == "" {
+				return i, fmt.Errorf(". 后面缺少class")
+			}
+			part.classes = append(part.classes, name)
+		case '[':
+			attr, next, err := parseAttrSelector(s, i+1)
+			if err != nil {
+				return next, err
+			}
+			part.attrs = append(part.attrs, attr)
+			i = next
+		default:
+			return i, fmt.Errorf("位置%d不支持的字符 %c", i+1, s[i])
+		}
+	}
+	if i == start {
+		return i, fmt.Errorf("位置%d缺少选择器", i+1)
+	}
+	return i, nil
+}
+
+func parseAttrSelector(s string, i int) (attrSelector, int, error) {
+	var attr attrSelector
+	skipSpace := func() {
+		for i < len(s) && isSelectorSpace(s[i]) {
+			i++
+		}
+	}
+	skipSpace()
+	attr.key, i = readIdent(s, i)
+	if attr.key == "" {
+		return attr, i, fmt.Errorf("[] 里缺少属性名")
+	}
+	attr.key = strings.ToLower(attr.key)
+	skipSpace()
+	if i < len(s) && s[i] == ']' {
+		return attr, i + 1, nil
+	}
+	for _, op := range []string{"=", "~=", "^=", "$=", "*="} {
+		if strings.HasPrefix(s[i:], op) {
+			attr.op = op
+			i += len(op)
+			break
+		}
+	}
+	if attr.op == "" {
+		return attr, i, fmt.Errorf("属性 %s 不支持的比较方式", attr.key)
+	}
+	skipSpace()
+	if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+		end := strings.IndexByte(s[i+1:], s[i])
+		if end < 0 {
+			return attr, i, fmt.Errorf("属性 %s 的值缺少结束引号", attr.key)
+		}
+		attr.val = s[i+1 : i+1+end]
+		i += end + 2
+	} else {
+		attr.val, i = readIdent(s, i)
+	}
+	skipSpace()
+	if i >= len(s) || s[i] != ']' {
+		return attr, i, fmt.Errorf("属性 %s 缺少 ]", attr.key)
+	}
+	return attr, i + 1, nil
+}
+
+func nodeAttr(node *html.Node, key string) (string, bool) {
+	for _, attr := range node.Attr {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func (part *selectorPart) match(node *html.Node) bool {
+	if node.Type != html.ElementNode {
+		return false
+	}
+	if part.tag != "" && part.tag != node.Data {
+		return false
+	}
+	if part.id != "" {
+		if id, _ := nodeAttr(node, "id"); id != part.id {
+			return false
+		}
+	}
+	if len(part.classes) > 0 {
+		class, _ := nodeAttr(node, "class")
+		classes := strings.Fields(class)
+		for _, name := range part.classes {
+			if !containsString(classes, name) {
+				return false
+			}
+		}
+	}
+	for _, attr := range part.attrs {
+		val, ok := nodeAttr(node, attr.key)
+		if !ok {
+			return false
+		}
+		switch attr.op {
+		case "=":
+			ok = val == attr.val
+		case "~=":
+			ok = containsString(strings.Fields(val), attr.val)
+		case "^=":
+			ok = attr.val != "" && strings.HasPrefix(val, attr.val)
+		case "$=":
+			ok = attr.val != "" && strings.HasSuffix(val, attr.val)
+		case "*=":
+			ok = attr.val != "" && strings.Contains(val, attr.val)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchParts 从右往左匹配，parts 的最后一部分匹配 node
+func matchParts(parts []selectorPart, node *html.Node) bool {
+	last := len(parts) - 1
+	if !parts[last].match(node) {
+		return false
+	}
+	if last == 0 {
+		return true
+	}
+	if parts[last].combinator == '>' {
+		return node.Parent != nil && matchParts(parts[:last], node.Parent)
+	}
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		if matchParts(parts[:last], parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWithin node 本身或者它的上级元素匹配选择器，文本节点从父元素开始
+func (selector cssSelector) matchWithin(node *html.Node) bool {
+	for ; node != nil; node = node.Parent {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		for _, parts := range selector {
+			if matchParts(parts, node) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "mirror_session"
+	sessionTimeout    = 12 * time.Hour
+	//同一IP对同一用户名连续失败 loginMaxFailures 次后锁定 loginLockTime
+	loginMaxFailures = 5
+	loginFailWindow  = 15 * time.Minute
+	loginLockTime    = 15 * time.Minute
+)
+
+type session struct {
+	userName string
+	expire   time.Time
+}
+
+// sessionStore 服务端保存的登录会话，重启后需要重新登录
+type sessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session)}
+}
+
+func (store *sessionStore) Create(userName string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	for key, s := range store.sessions {
+		if now.After(s.expire) {
+			delete(store.sessions, key)
+		}
+	}
+	store.sessions[token] = &session{userName: userName, expire: now.Add(sessionTimeout)}
+	return token, nil
+}
+
+// Get 返回会话对应的用户名，有访问时延长过期时间
+func (store *sessionStore) Get(token string) (string, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	s, ok := store.sessions[token]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	if now.After(s.expire) {
+		delete(store.sessions, token)
+		return "", false
+	}
+	s.expire = now.Add(sessionTimeout)
+	return s.userName, true
+}
+
+func (store *sessionStore) Delete(token string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.sessions, token)
+}
+
+// DeleteUser 删除用户的所有会话，修改密码后使用
+func (store *sessionStore) DeleteUser(userName string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for key, s := range store.sessions {
+		if s.userName == userName {
+			delete(store.sessions, key)
+		}
+	}
+}
+
+type loginAttempt struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter 登录失败次数限制，key 为IP加用户名
+type loginLimiter struct {
+	lock     sync.Mutex
+	attempts map[string]*loginAttempt
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{attempts: make(map[string]*loginAttempt)}
+}
+
+// Locked 返回剩余锁定时间，0表示未锁定
+func (limiter *loginLimiter) Locked(keys ...string) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	var remain time.Duration
+	for _, key := range keys {
+		attempt, ok := limiter.attempts[key]
+		if !ok {
+			continue
+		}
+		if left := attempt.lockedUntil.Sub(now); left > remain {
+			remain = left
+		}
+	}
+	return remain
+}
+
+func (limiter *loginLimiter) Fail(keys ...string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	for key, attempt := range limiter.attempts {
+		if now.Sub(attempt.first) > loginFailWindow && now.After(attempt.lockedUntil) {
+			delete(limiter.attempts, key)
+		}
+	}
+	for _, key := range keys {
+		attempt, ok := limiter.attempts[key]
+		if !ok {
+			attempt = &loginAttempt{first: now}
+			limiter.attempts[key] = attempt
+		}
+		attempt.failures++
+		if attempt.failures >= loginMaxFailures {
+			attempt.lockedUntil = now.Add(loginLockTime)
+			attempt.failures = 0
+			attempt.first = now
+		}
+	}
+}
+
+func (limiter *loginLimiter) Reset(keys ...string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	for _, key := range keys {
+		delete(limiter.attempts, key)
+	}
+}
@@ -0,0 +1,376 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// siteSheetHeader 导入导出的列，前14列和 muban.xlsx 相同，后面的列旧模板没有，导入时可以省略。
+// 被替换词、替换词只能表示普通替换，完整的替换规则在最后一列
+var siteSheetHeader = []string{
+	"域名", "镜像链接", "首页标题", "首页关键字", "首页描述", "被替换词", "替换词", "h1替换词",
+	"是否下载js", "转繁体", "是否标题替换", "缓存时间", "百度推送key", "神马推送key",
+	"开启缓存", "过期缓存时间", "替换规则(JSON)", "响应头规则(JSON)", "回源设置(JSON)",
+}
+
+func sheetBool(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// parseSheetBool 只有 0 和 false 为否，空单元格使用 empty，旧模板的开关列为空时是开启的
+func parseSheetBool(value string, empty bool) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return empty
+	}
+	return value != "0" && value != "false"
+}
+
+// siteConfigRow 按 siteSheetHeader 的顺序导出一行
+func siteConfigRow(siteConfig *SiteConfig) []string {
+	finds := make([]string, 0, len(siteConfig.Rules))
+	replaces := make([]string, 0, len(siteConfig.Rules))
+	for _, rule := range siteConfig.Rules {
+		finds = append(finds, rule.Find)
+		replaces = append(replaces, rule.Replace)
+	}
+	rules, _ := json.Marshal(siteConfig.Rules)
+	headerRules, _ := json.Marshal(siteConfig.HeaderRules)
+	upstream, _ := json.Marshal(siteConfig.Upstream)
+	return []string{
+		siteConfig.Domain,
+		siteConfig.Url,
+		siteConfig.IndexTitle,
+		siteConfig.IndexKeywords,
+		siteConfig.IndexDescription,
+		strings.Join(finds, ";"),
+		strings.Join(replaces, ";"),
+		siteConfig.H1Replace,
+		sheetBool(siteConfig.NeedJs),
+		sheetBool(siteConfig.S2t),
+		sheetBool(siteConfig.TitleReplace),
+		strconv.FormatInt(siteConfig.CacheTime, 10),
+		siteConfig.BaiduPushKey,
+		siteConfig.SmPushKey,
+		sheetBool(siteConfig.CacheEnable),
+		strconv.FormatInt(siteConfig.StaleTime, 10),
+		string(rules),
+		string(headerRules),
+		string(upstream),
+	}
+}
+
+// siteConfigFromRow 读取导入的一行，excel 会省略末尾的空单元格，缺少的列按空值处理。
+// 替换规则列为空时用被替换词、替换词生成普通替换
+func siteConfigFromRow(row []string) (*SiteConfig, error) {
+	if len(row) < len(siteSheetHeader) {
+		row = append(row, make([]string, len(siteSheetHeader)-len(row))...)
+	}
+	cacheTime, err := strconv.ParseInt(strings.TrimSpace(row[11]), 10, 64)
+	if err != nil || cacheTime == 0 {
+		cacheTime = 88888888
+	}
+	staleTime, err := strconv.ParseInt(strings.TrimSpace(row[15]), 10, 64)
+	if err != nil || staleTime < 0 {
+		staleTime = 0
+	}
+	var rules []ReplaceRule
+	if strings.TrimSpace(row[16]) != "" {
+		if err = json.Unmarshal([]byte(row[16]), &rules); err != nil {
+			return nil, fmt.Errorf("替换规则格式错误: %w", err)
+		}
+	} else {
+		rules = legacyRules(strings.Split(row[5], ";"), strings.Split(row[6], ";"))
+	}
+	var headerRules []HeaderRule
+	if strings.TrimSpace(row[17]) != "" {
+		if err = json.Unmarshal([]byte(row[17]), &headerRules); err != nil {
+			return nil, fmt.Errorf("响应头规则格式错误: %w", err)
+		}
+	}
+	var upstream UpstreamConfig
+	if strings.TrimSpace(row[18]) != "" {
+		decoder := json.NewDecoder(strings.NewReader(row[18]))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&upstream); err != nil {
+			return nil, fmt.Errorf("回源设置格式错误: %w", err)
+		}
+	}
+	return &SiteConfig{
+		Domain:           strings.TrimSpace(row[0]),
+		Url:              strings.TrimSpace(row[1]),
+		IndexTitle:       row[2],
+		IndexKeywords:    row[3],
+		IndexDescription: row[4],
+		Rules:            rules,
+		HeaderRules:      headerRules,
+		Upstream:         upstream,
+		H1Replace:        row[7],
+		NeedJs:           parseSheetBool(row[8], true),
+		S2t:              parseSheetBool(row[9], true),
+		TitleReplace:     parseSheetBool(row[10], true),
+		CacheEnable:      parseSheetBool(row[14], true),
+		CacheTime:        cacheTime,
+		BaiduPushKey:     row[12],
+		SmPushKey:        row[13],
+		StaleTime:        staleTime,
+	}, nil
+}
+
+// importRowError 导入时某一行的错误，Row 和excel的行号相同
+type importRowError struct {
+	Row    int    `json:"row"`
+	Domain string `json:"domain"`
+	Msg    string `json:"msg"`
+}
+
+// importResult 导入结果，出错的行计入 Skipped，insert 模式下已存在的域名也计入 Skipped
+type importResult struct {
+	Code    int              `json:"code"`
+	Msg     string           `json:"msg"`
+	DryRun  bool             `json:"dry_run"`
+	Added   int              `json:"added"`
+	Updated int              `json:"updated"`
+	Skipped int              `json:"skipped"`
+	Errors  []importRowError `json:"errors"`
+}
+
+// siteImport 导入xlsx，mode=insert(默认)跳过已存在的域名，mode=upsert 更新已存在的域名；
+// dry_run=1 只检查不保存，返回的统计和实际导入相同
+func (admin *AdminModule) siteImport(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	mode := request.FormValue("mode")
+	if mode == "" {
+		mode = "insert"
+	}
+	if mode != "insert" && mode != "upsert" {
+		_, _ = writer.Write([]byte(`{"code":5,"msg":"mode 只能是 insert 或 upsert"}`))
+		return
+	}
+	dryRun := parseSheetBool(request.FormValue("dry_run"), false)
+	mf, _, err := request.FormFile("file")
+	if err != nil {
+		writeResult(writer, 1, err.Error())
+		return
+	}
+	defer mf.Close()
+
+	f, err := excelize.OpenReader(mf)
+	if err != nil {
+		writeResult(writer, 2, err.Error())
+		return
+	}
+	defer f.Close()
+	sheet := "Sheet1"
+	if index, _ := f.GetSheetIndex(sheet); index < 0 {
+		sheet = f.GetSheetName(0)
+	}
+	rows, err := f.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		writeResult(writer, 2, err.Error())
+		return
+	}
+	if len(rows) == 0 || len(rows[0]) < 14 {
+		_, _ = writer.Write([]byte(`{"code":3,"msg":"表头缺少列，请使用 muban.xlsx 或导出的文件"}`))
+		return
+	}
+
+	result := &importResult{DryRun: dryRun, Errors: make([]importRowError, 0)}
+	account := requestUser(request)
+	seen := make(map[string]int)
+	adds := make([]*SiteConfig, 0)
+	updates := make([]*SiteConfig, 0)
+	befores := make(map[string]*SiteConfig)
+	for k, row := range rows {
+		if k == 0 || strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		rowError := func(domain, msg string) {
+			result.Skipped++
+			result.Errors = append(result.Errors, importRowError{Row: k + 1, Domain: domain, Msg: msg})
+		}
+		siteConfig, err := siteConfigFromRow(row)
+		if err != nil {
+			rowError(strings.TrimSpace(row[0]), err.Error())
+			continue
+		}
+		if siteConfig.Domain == "" || siteConfig.Url == "" {
+			rowError(siteConfig.Domain, "缺少列：域名和镜像链接不能为空")
+			continue
+		}
+		before := admin.siteSnapshot(strings.ToLower(strings.TrimSpace(siteConfig.Domain)))
+		if err := validateSiteConfig(siteConfig, before); err != nil {
+			rowError(siteConfig.Domain, err.Error())
+			continue
+		}
+		if first, ok := seen[siteConfig.Domain]; ok {
+			rowError(siteConfig.Domain, fmt.Sprintf("域名和第%d行重复", first))
+			continue
+		}
+		seen[siteConfig.Domain] = k + 1
+		if !account.CanEdit(siteConfig.Domain) {
+			rowError(siteConfig.Domain, "没有域名的权限")
+			continue
+		}
+		if before == nil {
+			adds = append(adds, siteConfig)
+			continue
+		}
+		if mode != "upsert" {
+			rowError(siteConfig.Domain, "域名已存在")
+			continue
+		}
+		befores[siteConfig.Domain] = before
+		updates = append(updates, siteConfig)
+	}
+	result.Added = len(adds)
+	result.Updated = len(updates)
+	if dryRun {
+		data, _ := json.Marshal(result)
+		_, _ = writer.Write(data)
+		return
+	}
+	if err = admin.dao.ImportMulti(adds, updates); err != nil {
+		writeResult(writer, 4, err.Error())
+		return
+	}
+	for _, siteConfig := range append(adds, updates...) {
+		admin.audit(request, AuditSiteImport, siteConfig.Domain, befores[siteConfig.Domain], admin.siteSnapshot(siteConfig.Domain))
+		if err := admin.app.MakeSite(siteConfig); err != nil {
+			admin.app.Logger.Error("import make site error", siteConfig.Domain, err.Error())
+		}
+	}
+	data, _ := json.Marshal(result)
+	_, _ = writer.Write(data)
+}
+
+// matchSite 域名和源站过滤，domain 支持 * ? 通配符，不带通配符时匹配域名和它的子域名；
+// origin 匹配源站主机名和它的子域名
+func matchSite(siteConfig *SiteConfig, domain, origin string) bool {
+	if domain != "" {
+		if strings.ContainsAny(domain, "*?[") {
+			if ok, _ := path.Match(domain, siteConfig.Domain); !ok {
+				return false
+			}
+		} else if siteConfig.Domain != domain && !strings.HasSuffix(siteConfig.Domain, "."+domain) {
+			return false
+		}
+	}
+	if origin != "" {
+		u, err := url.Parse(siteConfig.Url)
+		if err != nil {
+			return false
+		}
+		host := strings.ToLower(u.Hostname())
+		if host != origin && !strings.HasSuffix(host, "."+origin) {
+			return false
+		}
+	}
+	return true
+}
+
+// siteExport 导出站点配置，format 为 xlsx(默认)、csv 或 json。回源密码和令牌导出为 ******，导入新域名时需要改成实际的值
+func (admin *AdminModule) siteExport(writer http.ResponseWriter, request *http.Request) {
+	v := request.URL.Query()
+	format := strings.ToLower(v.Get("format"))
+	if format == "" {
+		format = "xlsx"
+	}
+	if format != "xlsx" && format != "csv" && format != "json" {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"格式只能是 xlsx、csv 或 json"}`))
+		return
+	}
+	domain := strings.ToLower(strings.TrimSpace(v.Get("domain")))
+	if _, err := path.Match(domain, ""); err != nil {
+		_, _ = writer.Write([]byte(`{"code":1,"msg":"域名通配符格式错误"}`))
+		return
+	}
+	origin := strings.ToLower(strings.TrimSpace(v.Get("origin")))
+	siteConfigs, err := admin.dao.GetAll()
+	if err != nil {
+		writeResult(writer, 2, err.Error())
+		return
+	}
+	sort.Slice(siteConfigs, func(i, j int) bool {
+		return siteConfigs[i].Id < siteConfigs[j].Id
+	})
+	results := make([]*SiteConfig, 0, len(siteConfigs))
+	for _, siteConfig := range siteConfigs {
+		if matchSite(siteConfig, domain, origin) {
+			results = append(results, siteConfig)
+		}
+	}
+
+	fileName := fmt.Sprintf("sites-%s.%s", time.Now().Format("20060102150405"), format)
+	writer.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+	switch format {
+	case "json":
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(results); err != nil {
+			admin.app.Logger.Error("export json error", err.Error())
+		}
+	case "csv":
+		writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		//带BOM，excel 打开时不会乱码
+		_, _ = writer.Write([]byte("\xef\xbb\xbf"))
+		w := csv.NewWriter(writer)
+		_ = w.Write(siteSheetHeader)
+		for _, siteConfig := range results {
+			_ = w.Write(siteConfigRow(siteConfig))
+		}
+		w.Flush()
+		if err = w.Error(); err != nil {
+			admin.app.Logger.Error("export csv error", err.Error())
+		}
+	default:
+		f := excelize.NewFile()
+		defer f.Close()
+		sw, err := f.NewStreamWriter("Sheet1")
+		if err == nil {
+			err = sw.SetRow("A1", stringCells(siteSheetHeader))
+		}
+		for i := 0; err == nil && i < len(results); i++ {
+			cell, _ := excelize.CoordinatesToCellName(1, i+2)
+			err = sw.SetRow(cell, stringCells(siteConfigRow(results[i])))
+		}
+		if err == nil {
+			err = sw.Flush()
+		}
+		if err != nil {
+			writer.Header().Del("Content-Disposition")
+			writeResult(writer, 3, err.Error())
+			return
+		}
+		writer.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		if err = f.Write(writer); err != nil {
+			admin.app.Logger.Error("export xlsx error", err.Error())
+		}
+	}
+}
+
+// stringCells 全部按文本写入，避免 0、长数字之类的内容被excel转换
+func stringCells(row []string) []interface{} {
+	cells := make([]interface{}, len(row))
+	for i, value := range row {
+		cells[i] = excelize.Cell{Value: value}
+	}
+	return cells
+}
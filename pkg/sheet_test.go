@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSiteConfigFromRowEmptySwitches(t *testing.T) {
+	//旧模板只有前14列，开关列为空
+	row := []string{"example.com", "http://origin.example.com", "标题", "关键字", "描述", "", "", "", "", "", "", "60"}
+	siteConfig, err := siteConfigFromRow(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !siteConfig.NeedJs || !siteConfig.S2t || !siteConfig.TitleReplace || !siteConfig.CacheEnable {
+		t.Fatalf("empty switch cells should stay enabled: %+v", siteConfig)
+	}
+
+	row = []string{"example.com", "http://origin.example.com", "标题", "关键字", "描述", "", "", "", "0", "false", "FALSE", "60", "", "", "0"}
+	if siteConfig, err = siteConfigFromRow(row); err != nil {
+		t.Fatal(err)
+	}
+	if siteConfig.NeedJs || siteConfig.S2t || siteConfig.TitleReplace || siteConfig.CacheEnable {
+		t.Fatalf("explicit 0/false should disable: %+v", siteConfig)
+	}
+}
+
+func TestSiteSheetRoundTrip(t *testing.T) {
+	siteConfig := &SiteConfig{
+		Domain:        "example.com",
+		Url:           "https://origin.example.com",
+		IndexTitle:    "标题",
+		IndexKeywords: "关键字",
+		H1Replace:     "h1",
+		S2t:           true,
+		CacheEnable:   true,
+		CacheTime:     30,
+		StaleTime:     5,
+		Rules:         []ReplaceRule{{Find: "a", Replace: "b", Enabled: true}},
+		HeaderRules:   []HeaderRule{},
+		Upstream:      UpstreamConfig{AuthType: AuthBasic, AuthUser: "user", AuthPassword: "secret", Origins: []string{"https://backup.example.com"}},
+	}
+	if err := validateSiteConfig(siteConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := siteConfigFromRow(siteConfigRow(siteConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Upstream.AuthPassword != secretMask {
+		t.Fatalf("exported password = %q, want it masked", imported.Upstream.AuthPassword)
+	}
+
+	//新域名没有原来的密码，不能保存成空密码
+	if err = validateSiteConfig(imported, nil); err == nil {
+		t.Fatal("want an error for a masked password on a new domain")
+	}
+
+	imported, _ = siteConfigFromRow(siteConfigRow(siteConfig))
+	if err = validateSiteConfig(imported, siteConfig); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(upstreamRecord(imported.Upstream))
+	want, _ := json.Marshal(upstreamRecord(siteConfig.Upstream))
+	if string(got) != string(want) {
+		t.Fatalf("upstream = %s, want %s", got, want)
+	}
+	imported.Upstream, siteConfig.Upstream = UpstreamConfig{}, UpstreamConfig{}
+	got, _ = json.Marshal(imported)
+	want, _ = json.Marshal(siteConfig)
+	if string(got) != string(want) {
+		t.Fatalf("site = %s, want %s", got, want)
+	}
+}
@@ -5,9 +5,7 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/md5"
-	"crypto/sha1"
-	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,11 +14,11 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/html"
@@ -29,9 +27,20 @@ import (
 type Site struct {
 	*SiteConfig
 	*httputil.ReverseProxy
-	Scheme    string
-	app       *Application
-	CachePath string
+	Scheme string
+	app    *Application
+	cache  CacheStore
+	*siteReplacer
+	headerRules []headerRule
+	metrics     *siteMetrics
+	transport   *http.Transport
+	pool        *originPool
+	//正在处理的请求，替换缓存后等这些请求结束再关闭旧缓存
+	requests int64
+	//每次创建都不同，替换后html缓存用来判断站点是否重建
+	generation uint64
+	//正在后台更新的缓存key，同一个key只更新一次
+	refreshing sync.Map
 }
 type CustomResponse struct {
 	StatusCode int
@@ -41,42 +50,105 @@ type CustomResponse struct {
 	Header http.Header
 
 	RandomHtml string
+	// ETag and LastModified are the origin's validators, used for conditional revalidation
+	ETag         string
+	LastModified string
 }
 type Key uint
 
 const (
 	ORIGIN_UA Key = iota
 	REQUEST_HOST
+	ACCESS_RECORD
+	REVALIDATE
+	ADMIN_USER
+	ORIGIN_ATTEMPT
 )
 
+type cacheState int
+
+const (
+	cacheFresh cacheState = iota
+	cacheStale            //过期但在 StaleTime 内，可以先返回
+	cacheExpired
+)
+
+// revalidation 缓存过期后带上 ETag/Last-Modified 向源站确认，源站返回304时继续使用缓存
+type revalidation struct {
+	cacheKey string
+	response *CustomResponse
+	//客户端自己的条件请求是否和缓存匹配
+	notModified bool
+}
+
 func NewSite(siteConfig *SiteConfig, app *Application) error {
-	u, err := url.Parse(siteConfig.Url)
+	site, err := newSite(siteConfig, app, app.Config())
 	if err != nil {
 		return err
 	}
+	app.storeSite(site)
+	return nil
+}
+
+// storeSite 注册站点，替换原来的站点时沿用源站状态，并关闭原来站点的空闲连接
+func (app *Application) storeSite(site *Site) {
+	value, loaded := app.Sites.Load(site.Domain)
+	if loaded {
+		site.pool.inherit(value.(*Site).pool, &value.(*Site).Upstream, &site.Upstream)
+	}
+	app.Sites.Store(site.Domain, site)
+	if loaded {
+		value.(*Site).transport.CloseIdleConnections()
+	}
+}
+
+// deleteSite 删除站点并关闭它的空闲连接
+func (app *Application) deleteSite(domain string) {
+	if value, loaded := app.Sites.LoadAndDelete(domain); loaded {
+		value.(*Site).transport.CloseIdleConnections()
+	}
+}
+
+// newSite 根据指定的全局配置创建站点，不注册到app.Sites
+func newSite(siteConfig *SiteConfig, app *Application, appConfig *AppConfig) (*Site, error) {
+	pool, urls, err := newOriginPool(siteConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	siteConfig.IndexTitle = HtmlEntities(siteConfig.IndexTitle)
 	siteConfig.IndexKeywords = HtmlEntities(siteConfig.IndexKeywords)
 	siteConfig.IndexDescription = HtmlEntities(siteConfig.IndexDescription)
-	for _, item := range app.GlobalReplace {
-		siteConfig.Replaces = append(siteConfig.Replaces, item["replace"])
-		siteConfig.Finds = append(siteConfig.Finds, item["needle"])
-	}
-	for i, replace := range siteConfig.Replaces {
-		siteConfig.Replaces[i] = HtmlEntities(replace)
-	}
 
-	proxy := newProxy(u, app.IpList)
-	site := &Site{SiteConfig: siteConfig, ReverseProxy: proxy, CachePath: app.CachePath, app: app}
+	site := &Site{SiteConfig: siteConfig, app: app, cache: app.CacheStore(), siteReplacer: newSiteReplacer(siteRules(siteConfig, appConfig), urls), headerRules: newHeaderRules(siteConfig.HeaderRules), pool: pool, generation: nextGeneration()}
+	proxy, err := newProxy(site.originTarget, app.IpList, appConfig.UpstreamHttp2, upstreamConnectTimeout(appConfig))
+	if err != nil {
+		return nil, err
+	}
+	site.ReverseProxy = proxy
+	site.metrics = app.siteMetrics(siteConfig.Domain)
+	site.transport = proxy.Transport.(*http.Transport)
+	site.transport.MaxConnsPerHost = siteConfig.Upstream.MaxConns
+	proxy.Transport = &originTransport{RoundTripper: &metricsTransport{RoundTripper: site.transport, metrics: site.metrics}, pool: pool}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		site.applyUpstream(req)
+	}
 	proxy.ModifyResponse = func(r *http.Response) error {
-		return site.ModifyResponse(r)
+		if err := site.ModifyResponse(r); err != nil {
+			return err
+		}
+		site.applyHeaderRules(r.Header, r.Request.URL.Path)
+		return nil
 	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if site.retryOrigin(w, r, err) {
+			return
+		}
 		site.ErrorHandler(w, r, err)
 	}
-
-	app.Sites.Store(siteConfig.Domain, site)
-	return nil
+	return site, nil
 }
 
 func (site *Site) Route(writer http.ResponseWriter, request *http.Request) {
@@ -91,44 +163,36 @@ func (site *Site) Route(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	cacheKey := site.Domain + request.URL.Path + request.URL.RawQuery
-	if site.CacheEnable {
-		if cacheResponse := site.getCache(cacheKey, false); cacheResponse != nil {
-			contentType := strings.ToLower(cacheResponse.Header.Get("Content-Type"))
-			var content []byte = cacheResponse.Body
-			if strings.Contains(contentType, "text/html") {
-				isIndexPage := isIndexPage(request.URL)
-				isSpider := site.isCrawler(ua)
-				requestPath := request.URL.Path
-				content = site.handleHtmlResponse(content, isIndexPage, isSpider, contentType, requestHost, requestPath, cacheResponse.RandomHtml)
-			} else if strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
-				content = GBk2UTF8(content, contentType)
-				for index, find := range site.Finds {
-					content = bytes.ReplaceAll(content, []byte(find), []byte(site.Replaces[index]))
-				}
-				contentStr := site.replaceHost(string(content), requestHost)
-				content = []byte(contentStr)
-			}
-
-			for key, values := range cacheResponse.Header {
-				writer.Header()[key] = values
-			}
-			contentLength := int64(len(content))
-			writer.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-			if cacheResponse.StatusCode != 0 {
-				writer.WriteHeader(cacheResponse.StatusCode)
+	if !site.CacheEnable {
+		site.metrics.addCache(CacheBypass)
+	} else {
+		entry, state := site.openCache(cacheKey)
+		if entry != nil && state != cacheExpired {
+			markCacheHit(request)
+			if state == cacheStale {
+				site.metrics.addCache(CacheStale)
+				site.refreshCache(request, cacheKey, entry.Response)
 			} else {
-				writer.WriteHeader(200)
-			}
-			_, err := writer.Write(content)
-			if err != nil {
-				site.app.Logger.Error("写出错误：", err.Error(), requestHost, request.URL)
+				site.metrics.addCache(CacheHit)
 			}
+			site.serveCache(writer, request, cacheKey, entry)
 			return
 		}
+		site.metrics.addCache(CacheMiss)
+		if entry != nil {
+			entry.Body.Close()
+			if cacheResponse := entry.Response; cacheResponse.ETag != "" || cacheResponse.LastModified != "" {
+				request = request.WithContext(context.WithValue(request.Context(), REVALIDATE, &revalidation{
+					cacheKey:    cacheKey,
+					response:    cacheResponse,
+					notModified: !isTextContent(strings.ToLower(cacheResponse.Header.Get("Content-Type"))) && notModified(request, cacheResponse),
+				}))
+			}
+		}
 
 	}
-	if site.app.UserAgent != "" {
-		request.Header.Set("User-Agent", site.app.UserAgent)
+	if userAgent := site.app.Config().UserAgent; userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
 	}
 	site.ServeHTTP(writer, request)
 
@@ -139,12 +203,21 @@ func (site *Site) ModifyResponse(response *http.Response) error {
 		return site.handleRedirectResponse(response, requestHost)
 	}
 	cacheKey := site.Domain + response.Request.URL.Path + response.Request.URL.RawQuery
+	if response.StatusCode == http.StatusNotModified {
+		if revalidate, ok := response.Request.Context().Value(REVALIDATE).(*revalidation); ok {
+			return site.handleNotModified(response, revalidate)
+		}
+		return nil
+	}
 	if response.StatusCode == 200 {
+		contentType := strings.ToLower(response.Header.Get("Content-Type"))
+		if !isTextContent(contentType) {
+			return site.streamResponse(response, cacheKey)
+		}
 		content, err := site.readResponse(response)
 		if err != nil {
 			return err
 		}
-		contentType := strings.ToLower(response.Header.Get("Content-Type"))
 
 		if strings.Contains(contentType, "text/html") {
 			content = bytes.ReplaceAll(content, []byte("\u200B"), []byte(""))
@@ -157,24 +230,23 @@ func (site *Site) ModifyResponse(response *http.Response) error {
 			originUa := response.Request.Context().Value(ORIGIN_UA).(string)
 			isSpider := site.isCrawler(originUa)
 			requestPath := response.Request.URL.Path
+			start := time.Now()
 			content = site.handleHtmlResponse(content, isIndexPage(response.Request.URL), isSpider, contentType, requestHost, requestPath, randomHtml)
+			elapsed := time.Since(start)
+			addRenderTime(response.Request, elapsed)
+			site.metrics.render.observe(elapsed.Seconds())
 			site.wrapResponseBody(response, content)
 			return nil
 		} else if strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
 			_ = site.setCache(cacheKey, response.StatusCode, response.Header, content, "")
 			content = GBk2UTF8(content, contentType)
-			for index, find := range site.Finds {
-				content = bytes.ReplaceAll(content, []byte(find), []byte(site.Replaces[index]))
-			}
-			contentStr := site.replaceHost(string(content), requestHost)
+			contentStr := site.replaceHost(site.asset.Replace(string(content), replaceTarget{path: response.Request.URL.Path}), requestHost)
 
 			content = []byte(contentStr)
 			site.wrapResponseBody(response, content)
 			return nil
 
 		}
-		_ = site.setCache(cacheKey, response.StatusCode, response.Header, content, "")
-		site.wrapResponseBody(response, content)
 		return nil
 
 	}
@@ -187,12 +259,87 @@ func (site *Site) ModifyResponse(response *http.Response) error {
 	return nil
 }
 
+// streamResponse 非文本内容不读入内存，转发给客户端的同时写入缓存
+func (site *Site) streamResponse(response *http.Response, cacheKey string) error {
+	switch response.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		reader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return err
+		}
+		response.Body = &gzipReadCloser{Reader: reader, body: response.Body}
+		response.Header.Del("Content-Length")
+		response.ContentLength = -1
+	default:
+		//其他压缩格式不缓存，原样转发
+		return nil
+	}
+	normalizeCacheHeader(response.Header)
+	limit := site.app.Config().MaxCacheSize * 1024 * 1024
+	if limit > 0 && response.ContentLength > limit {
+		return nil
+	}
+	resp := &CustomResponse{
+		StatusCode:   response.StatusCode,
+		Header:       response.Header.Clone(),
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}
+	cacheWriter, err := site.cache.Writer(site.Domain, cacheKey, resp, limit)
+	if err != nil {
+		site.app.Logger.Error("create cache error", cacheKey, err.Error())
+		return nil
+	}
+	response.Body = &cacheTeeBody{ReadCloser: response.Body, cache: cacheWriter, site: site}
+	return nil
+}
+
+// handleNotModified 源站确认缓存未修改，刷新缓存时间并用缓存内容响应
+func (site *Site) handleNotModified(response *http.Response, revalidate *revalidation) error {
+	if err := site.cache.Touch(site.Domain, revalidate.cacheKey); err != nil {
+		site.app.Logger.Error("touch cache error", revalidate.cacheKey, err.Error())
+	}
+	entry, _ := site.openCache(revalidate.cacheKey)
+	if entry == nil {
+		return errors.New("缓存不存在")
+	}
+	_ = response.Body.Close()
+	cacheResponse, body := entry.Response, entry.Body
+	response.Header = cacheResponse.Header.Clone()
+	if revalidate.notModified {
+		body.Close()
+		response.Header.Del("Content-Length")
+		response.Body = http.NoBody
+		response.ContentLength = 0
+		return nil
+	}
+	response.StatusCode = cacheResponse.StatusCode
+	if response.StatusCode == 0 {
+		response.StatusCode = 200
+	}
+	contentType := strings.ToLower(cacheResponse.Header.Get("Content-Type"))
+	if !isTextContent(contentType) {
+		response.Body = body
+		response.ContentLength = body.Size()
+		response.Header.Set("Content-Length", strconv.FormatInt(body.Size(), 10))
+		return nil
+	}
+	content, err := site.renderCache(response.Request, revalidate.cacheKey, entry)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	site.wrapResponseBody(response, content)
+	return nil
+}
+
 func (site *Site) handleRedirectResponse(response *http.Response, host string) error {
 	redirectUrl, err := response.Request.URL.Parse(response.Header.Get("Location"))
 	if err != nil {
 		return err
 	}
-	if redirectUrl.Host == response.Request.URL.Host {
+	if redirectUrl.Host == response.Request.URL.Host || site.isOriginHost(redirectUrl.Host) {
 		redirectUrl.Host = host
 		redirectUrl.Scheme = site.Scheme
 	}
@@ -202,8 +349,22 @@ func (site *Site) handleRedirectResponse(response *http.Response, host string) e
 func (site *Site) handleHtmlNode(node *html.Node, requestHost string, requestPath string, isIndexPage bool, replacedH1 *bool) {
 	switch node.Type {
 	case html.TextNode, html.CommentNode, html.RawNode:
-		node.Data = site.transformText(node.Data)
+		node.Data = site.transformText(node.Data, replaceTarget{path: requestPath, node: node})
 	case html.ElementNode:
+		//属性替换在下面的链接处理之前，规则里的 href、src 匹配的是源站原来的值
+		for i, attr := range node.Attr {
+			// if attr.Key == "href" || attr.Key == "src" {
+			// 	node.Attr[i].Val = site.replaceHost(attr.Val, requestHost)
+			// }
+			key := strings.ToLower(attr.Key)
+			if site.attrNames[key] {
+				attr.Val = site.attr.Replace(attr.Val, replaceTarget{path: requestPath, node: node, attr: key})
+				node.Attr[i].Val = attr.Val
+				if site.S2t && defaultAttrs[key] {
+					node.Attr[i].Val, _ = site.app.S2T.Convert(attr.Val)
+				}
+			}
+		}
 		if node.Data == "a" {
 			site.transformANode(node, requestHost, requestPath)
 		}
@@ -231,7 +392,7 @@ func (site *Site) handleHtmlNode(node *html.Node, requestHost string, requestPat
 				})
 			}
 		}
-		if node.Data == "head" && site.app.AdDomains[site.Domain] {
+		if node.Data == "head" && site.app.Config().AdDomains[site.Domain] {
 			node.AppendChild(&html.Node{
 				Type: html.TextNode,
 				Data: "{{inject_js}}",
@@ -241,25 +402,6 @@ func (site *Site) handleHtmlNode(node *html.Node, requestHost string, requestPat
 			node.FirstChild.Data = site.H1Replace
 			*replacedH1 = true
 		}
-		for i, attr := range node.Attr {
-			// if attr.Key == "href" || attr.Key == "src" {
-			// 	node.Attr[i].Val = site.replaceHost(attr.Val, requestHost)
-			// }
-			if strings.EqualFold(attr.Key, "title") ||
-				strings.EqualFold(attr.Key, "alt") ||
-				strings.EqualFold(attr.Key, "value") ||
-				strings.EqualFold(attr.Key, "placeholder") ||
-				strings.EqualFold(attr.Key, "content") {
-				for index, find := range site.Finds {
-					tag := fmt.Sprintf("{{replace:%d}}", index)
-					attr.Val = strings.ReplaceAll(attr.Val, find, tag)
-				}
-				node.Attr[i].Val = attr.Val
-				if site.S2t {
-					node.Attr[i].Val, _ = site.app.S2T.Convert(attr.Val)
-				}
-			}
-		}
 
 	}
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
@@ -314,14 +456,10 @@ func (site *Site) transformScriptNode(node *html.Node) {
 	}
 
 }
-func (site *Site) transformText(text string) string {
-	for index, find := range site.Finds {
-		tag := fmt.Sprintf("{{replace:%d}}", index)
-		text = strings.ReplaceAll(text, find, tag)
-	}
+func (site *Site) transformText(text string, target replaceTarget) string {
+	text = site.text.Replace(text, target)
 	//text = site.replaceHost(text, requestHost)
 	if site.S2t {
-		chineseRegexp, _ := regexp.Compile("^[\u4e00-\u9fa5]+")
 		text = chineseRegexp.ReplaceAllStringFunc(text, func(s string) string {
 			result, _ := site.app.S2T.Convert(s)
 			return result
@@ -359,7 +497,7 @@ func (site *Site) transformANode(node *html.Node, requestHost string, requestPat
 		if u == nil {
 			break
 		}
-		if u.Host == ou.Host {
+		if site.isOriginHost(u.Host) {
 			u.Scheme = site.Scheme
 			u.Host = requestHost
 			node.Attr[i].Val = u.String()
@@ -377,40 +515,38 @@ func (site *Site) transformANode(node *html.Node, requestHost string, requestPat
 	}
 }
 func (site *Site) parseTemplateTags(content []byte, requestHost string, randomHtml string, isIndexPage bool) []byte {
+	appConfig := site.app.Config()
 	contentStr := string(content)
 	contentStr = site.replaceHost(contentStr, requestHost)
 	contentStr = strings.Replace(contentStr, "{{index_title}}", site.IndexTitle, 1)
 	contentStr = strings.Replace(contentStr, "{{index_keywords}}", site.IndexKeywords, 1)
 	contentStr = strings.Replace(contentStr, "{{index_description}}", site.IndexDescription, 1)
 	contentStr = strings.Replace(contentStr, "{{random_html}}", randomHtml, 1)
-	injectJs := fmt.Sprintf(`<script type="text/javascript" src="%s"></script>`, site.app.InjectJsPath)
+	injectJs := fmt.Sprintf(`<script type="text/javascript" src="%s"></script>`, appConfig.InjectJsPath)
 	contentStr = strings.Replace(contentStr, "{{inject_js}}", injectJs, 1)
 	if isIndexPage {
 		friendLink := site.friendLink(site.Domain)
 		contentStr = strings.Replace(contentStr, "{{friend_links}}", friendLink, 1)
 	}
 
-	keywordRegexp, _ := regexp.Compile(`\{\{keyword:(\d+)\}\}`)
 	keywordTags := keywordRegexp.FindAllStringSubmatch(contentStr, -1)
 	for _, keywordTag := range keywordTags {
 		index, err := strconv.Atoi(keywordTag[1])
 		if err != nil {
 			continue
 		}
-		contentStr = strings.ReplaceAll(contentStr, keywordTag[0], site.app.Keywords[index])
-	}
-	replaceRegexp, _ := regexp.Compile(`\{\{replace:(\d+)\}\}`)
-	replaceTags := replaceRegexp.FindAllStringSubmatch(contentStr, -1)
-	for _, replaceTag := range replaceTags {
-		index, err := strconv.Atoi(replaceTag[1])
-		if err != nil {
+		if index >= len(appConfig.Keywords) {
 			continue
 		}
-		contentStr = strings.ReplaceAll(contentStr, replaceTag[0], site.Replaces[index])
+		contentStr = strings.ReplaceAll(contentStr, keywordTag[0], appConfig.Keywords[index])
 	}
+	contentStr = site.tag.Replace(contentStr)
 	return []byte(contentStr)
 }
 func (site *Site) handleHtmlResponse(content []byte, isIndexPage bool, isSpider bool, contentType string, requestHost string, requestPath string, randomHtml string) []byte {
+	if len(site.body) > 0 {
+		content = []byte(site.body.Replace(string(content), replaceTarget{path: requestPath}))
+	}
 	content = site.handleHtmlContent(content, requestHost, requestPath, isIndexPage)
 	content = site.parseTemplateTags(content, requestHost, randomHtml, isIndexPage)
 	return content
@@ -491,8 +627,7 @@ func (site *Site) DecodeUrl(u *url.URL) {
 		return
 	}
 
-	r, _ := regexp.Compile(`^/([a-f\d]{5}_)`)
-	matches := r.FindStringSubmatch(u.Path)
+	matches := encodedPathRegexp.FindStringSubmatch(u.Path)
 	if len(matches) != 2 {
 		return
 	}
@@ -516,21 +651,18 @@ func (site *Site) DecodeUrl(u *url.URL) {
 }
 
 func (site *Site) replaceHost(content string, requestHost string) string {
-	u, _ := url.Parse(site.Url)
-	content = strings.ReplaceAll(content, u.Host, requestHost)
+	for _, originHost := range site.originHosts {
+		content = strings.ReplaceAll(content, originHost, requestHost)
+	}
 	if site.Scheme == "https" {
 		content = strings.ReplaceAll(content, "http://"+requestHost, "https://"+requestHost)
 	} else {
 		content = strings.ReplaceAll(content, "https://"+requestHost, "http://"+requestHost)
 	}
-	originHost := u.Host
-	hostParts := strings.Split(u.Host, ".")
-	if len(hostParts) >= 3 {
-		originHost = strings.Join(hostParts[1:], ".")
+	content = site.subDomainRegexp.ReplaceAllString(content, "")
+	for _, originDomain := range site.originDomains {
+		content = strings.ReplaceAll(content, originDomain, site.Domain)
 	}
-	subDomainRegexp, _ := regexp.Compile(`[a-zA-Z0-9]+\.` + originHost)
-	content = subDomainRegexp.ReplaceAllString(content, "")
-	content = strings.ReplaceAll(content, originHost, site.Domain)
 	return content
 }
 func (site *Site) transformTitleNode(node *html.Node, isIndexPage bool) {
@@ -542,9 +674,10 @@ func (site *Site) transformTitleNode(node *html.Node, isIndexPage bool) {
 		return
 	}
 
-	if !isIndexPage && len(site.app.Keywords) > 0 && node.FirstChild != nil && node.FirstChild.Type == html.TextNode {
+	keywords := site.app.Config().Keywords
+	if !isIndexPage && len(keywords) > 0 && node.FirstChild != nil && node.FirstChild.Type == html.TextNode {
 		title := node.FirstChild.Data
-		randIndex := rand.Intn(len(site.app.Keywords))
+		randIndex := rand.Intn(len(keywords))
 		d := []rune(title)
 		length := strings.Count(title, "")
 		n := rand.Intn(length)
@@ -555,62 +688,70 @@ func (site *Site) transformTitleNode(node *html.Node, isIndexPage bool) {
 }
 
 func (site *Site) setCache(url string, statusCode int, header http.Header, content []byte, randomHtml string) error {
-	contentType := header.Get("Content-Type")
-	if strings.Contains(strings.ToLower(contentType), "charset") {
-		contentPartArr := strings.Split(contentType, ";")
-		header.Set("Content-Type", contentPartArr[0]+"; charset=utf-8")
+	normalizeCacheHeader(header)
+	limit := site.app.Config().MaxCacheSize * 1024 * 1024
+	if limit > 0 && int64(len(content)) > limit {
+		return errCacheTooLarge
 	}
-	header.Del("Content-Encoding")
-	header.Del("Content-Security-Policy")
 	resp := &CustomResponse{
-		Body:       content,
-		StatusCode: statusCode,
-		Header:     header,
-		RandomHtml: randomHtml,
-	}
-	sum := sha1.Sum([]byte(url))
-	hash := hex.EncodeToString(sum[:])
-	dir := path.Join(site.CachePath, site.Domain, hash[:2])
-	if !isExist(dir) {
-		err := os.MkdirAll(dir, os.ModePerm)
-		if err != nil {
-			site.app.Logger.Error("MkdirAll error", dir, err.Error())
-			return err
-		}
-	}
-	filename := path.Join(dir, hash)
-	file, err := os.Create(filename)
-	if err != nil {
-		site.app.Logger.Error("os.Create error", filename, err.Error())
-		return err
-	}
-	defer file.Close()
-	if err := gob.NewEncoder(file).Encode(resp); err != nil {
-		site.app.Logger.Error("gob.NewEncoder error", filename, err.Error())
+		Body:         content,
+		StatusCode:   statusCode,
+		Header:       header.Clone(),
+		RandomHtml:   randomHtml,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+	if err := site.cache.Put(site.Domain, url, resp); err != nil {
+		site.app.Logger.Error("set cache error", url, err.Error())
 		return err
 	}
 	return nil
 }
-func (site *Site) getCache(requestUrl string, force bool) *CustomResponse {
-	sum := sha1.Sum([]byte(requestUrl))
-	hash := hex.EncodeToString(sum[:])
-	dir := path.Join(site.CachePath, site.Domain, hash[:2])
-	filename := path.Join(dir, hash)
-	fileInfo, err := os.Stat(filename)
+
+// openCache 返回缓存和缓存状态，响应体由调用方关闭
+func (site *Site) openCache(requestUrl string) (*CacheEntry, cacheState) {
+	entry, err := site.cache.Get(site.Domain, requestUrl)
 	if err != nil {
-		return nil
+		if err != ErrCacheMiss {
+			site.app.Logger.Error("get cache error", requestUrl, err.Error())
+		}
+		return nil, cacheExpired
 	}
-	if modTime := fileInfo.ModTime(); !force && time.Now().Unix() > modTime.Unix()+site.CacheTime*60 {
-		return nil
+	age := time.Now().Unix() - entry.ModTime.Unix()
+	if age <= site.CacheTime*60 {
+		return entry, cacheFresh
 	}
+	if age <= (site.CacheTime+site.StaleTime)*60 {
+		return entry, cacheStale
+	}
+	return entry, cacheExpired
+}
 
-	if file, err := os.Open(filename); err == nil {
-		resp := new(CustomResponse)
-		gob.NewDecoder(file).Decode(resp)
-		file.Close()
-		return resp
+// refreshCache 后台请求源站更新缓存，同一个key同时只有一个请求
+func (site *Site) refreshCache(request *http.Request, cacheKey string, cacheResponse *CustomResponse) {
+	if request.Method != http.MethodGet {
+		return
 	}
-	return nil
+	if _, loaded := site.refreshing.LoadOrStore(cacheKey, true); loaded {
+		return
+	}
+	ctx := context.WithValue(context.Background(), ORIGIN_UA, request.Context().Value(ORIGIN_UA))
+	ctx = context.WithValue(ctx, REQUEST_HOST, request.Context().Value(REQUEST_HOST))
+	if cacheResponse.ETag != "" || cacheResponse.LastModified != "" {
+		ctx = context.WithValue(ctx, REVALIDATE, &revalidation{cacheKey: cacheKey, response: cacheResponse})
+	}
+	refreshRequest := request.Clone(ctx)
+	refreshRequest.Body = http.NoBody
+	refreshRequest.Header.Del("Range")
+	if userAgent := site.app.Config().UserAgent; userAgent != "" {
+		refreshRequest.Header.Set("User-Agent", userAgent)
+	}
+	atomic.AddInt64(&site.requests, 1)
+	go func() {
+		defer atomic.AddInt64(&site.requests, -1)
+		defer site.refreshing.Delete(cacheKey)
+		site.ServeHTTP(&discardWriter{header: make(http.Header)}, refreshRequest)
+	}()
 }
 
 func isExist(path string) bool {
@@ -622,11 +763,12 @@ func isExist(path string) bool {
 
 }
 func (site *Site) friendLink(domain string) string {
-	if len(site.app.FriendLinks[domain]) <= 0 {
+	links := site.app.Config().FriendLinks[domain]
+	if len(links) <= 0 {
 		return ""
 	}
 	var friendLink string
-	for _, link := range site.app.FriendLinks[domain] {
+	for _, link := range links {
 		linkItem := strings.Split(link, ",")
 		if len(linkItem) != 2 {
 			continue
@@ -636,19 +778,23 @@ func (site *Site) friendLink(domain string) string {
 	return fmt.Sprintf("<div style='display:none'>%s</div>", friendLink)
 }
 func (site *Site) isCrawler(ua string) bool {
+	return site.crawlerName(ua) != ""
+}
 
+// crawlerName 返回匹配到的蜘蛛名称，不是蜘蛛返回空
+func (site *Site) crawlerName(ua string) string {
 	ua = strings.ToLower(ua)
-	for _, value := range site.app.Spider {
+	for _, value := range site.app.Config().Spider {
 		spider := strings.ToLower(value)
 		if strings.Contains(ua, spider) {
-			return true
+			return value
 		}
 	}
-	return false
+	return ""
 }
 func (site *Site) isGoodCrawler(ua string) bool {
 	ua = strings.ToLower(ua)
-	for _, value := range site.app.GoodSpider {
+	for _, value := range site.app.Config().GoodSpider {
 		spider := strings.ToLower(value)
 		if strings.Contains(ua, spider) {
 			return true
@@ -662,45 +808,166 @@ func (site *Site) wrapResponseBody(response *http.Response, content []byte) {
 	response.Body = readAndCloser
 	response.ContentLength = contentLength
 	response.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	stripValidators(response.Header)
+}
+
+// stripValidators 改写过的内容随请求域名、规则和配置变化，源站的 ETag/Last-Modified 不能代表返回给客户端的内容
+func stripValidators(header http.Header) {
+	header.Del("ETag")
+	header.Del("Last-Modified")
 }
 func (site *Site) ErrorHandler(writer http.ResponseWriter, request *http.Request, e error) {
-	site.app.Logger.Error(request.URL.String(), e.Error())
-	requestHost := request.Context().Value(REQUEST_HOST).(string)
-	ua := request.Context().Value(ORIGIN_UA).(string)
+	//熔断时每个请求都会到这里，不记录日志
+	if !errors.Is(e, errBreakerOpen) {
+		site.app.Logger.Error(request.URL.String(), e.Error())
+	}
+	site.metrics.addOriginError()
 	cacheKey := site.Domain + request.URL.Path + request.URL.RawQuery
-	cacheResponse := site.getCache(cacheKey, true)
-	if cacheResponse == nil {
+	entry, _ := site.openCache(cacheKey)
+	if entry == nil {
+		site.applyHeaderRules(writer.Header(), request.URL.Path)
 		writer.WriteHeader(404)
 		writer.Write([]byte("请求出错，请检查源站"))
 		return
 
 	}
-	var content = cacheResponse.Body
+	markCacheHit(request)
+	site.serveCache(writer, request, cacheKey, entry)
+}
+
+// serveCache 输出缓存内容，文本内容需要替换后输出，其他内容直接从缓存输出
+func (site *Site) serveCache(writer http.ResponseWriter, request *http.Request, cacheKey string, entry *CacheEntry) {
+	cacheResponse, body := entry.Response, entry.Body
+	defer body.Close()
+	requestHost := request.Context().Value(REQUEST_HOST).(string)
 	contentType := strings.ToLower(cacheResponse.Header.Get("Content-Type"))
-	if strings.Contains(contentType, "text/html") {
-		isIndexPage := isIndexPage(request.URL)
-		isSpider := site.isCrawler(ua)
-		requestPath := request.URL.Path
-		content = site.handleHtmlResponse(content, isIndexPage, isSpider, contentType, requestHost, requestPath, cacheResponse.RandomHtml)
-	} else if strings.Contains(contentType, "css") || strings.Contains(contentType, "javascript") {
-		content = GBk2UTF8(content, contentType)
-		contentStr := site.replaceHost(string(content), requestHost)
-		content = []byte(contentStr)
+	for key, values := range cacheResponse.Header {
+		//复制一份，响应头规则 add 时不能改到缓存里的切片
+		writer.Header()[key] = append([]string(nil), values...)
+	}
+	site.applyHeaderRules(writer.Header(), request.URL.Path)
+	statusCode := cacheResponse.StatusCode
+	if statusCode == 0 {
+		statusCode = 200
+	}
+	textContent := isTextContent(contentType)
+	if textContent {
+		stripValidators(writer.Header())
+	}
+	//只有原样返回的非文本内容才能按源站的 ETag/Last-Modified 返回304
+	if statusCode == 200 && !textContent && notModified(request, cacheResponse) {
+		writer.Header().Del("Content-Length")
+		writer.WriteHeader(http.StatusNotModified)
+		return
 	}
-
-	for s, i := range cacheResponse.Header {
-		writer.Header()[s] = i
+	if !textContent {
+		if statusCode == 200 {
+			http.ServeContent(writer, request, "", time.Time{}, body)
+			return
+		}
+		writer.Header().Set("Content-Length", strconv.FormatInt(body.Size(), 10))
+		writer.WriteHeader(statusCode)
+		if _, err := io.Copy(writer, body); err != nil {
+			site.app.Logger.Error("写出错误：", err.Error(), requestHost, request.URL)
+		}
+		return
+	}
+	content, err := site.renderCache(request, cacheKey, entry)
+	if err != nil {
+		site.app.Logger.Error("读取缓存错误：", err.Error(), requestHost, request.URL)
+		writer.WriteHeader(500)
+		return
 	}
 	contentLength := int64(len(content))
 	writer.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	if cacheResponse.StatusCode != 0 {
-		writer.WriteHeader(cacheResponse.StatusCode)
-	} else {
-		writer.WriteHeader(200)
+	writer.WriteHeader(statusCode)
+	_, err = writer.Write(content)
+	if err != nil {
+		site.app.Logger.Error("写出错误：", err.Error(), requestHost, request.URL)
+	}
+
+}
+
+// renderCache 读取缓存的html、css、js并做替换，html的替换结果保存到HtmlCache
+func (site *Site) renderCache(request *http.Request, cacheKey string, entry *CacheEntry) ([]byte, error) {
+	requestHost := request.Context().Value(REQUEST_HOST).(string)
+	contentType := strings.ToLower(entry.Response.Header.Get("Content-Type"))
+	if !strings.Contains(contentType, "text/html") {
+		content, err := io.ReadAll(entry.Body)
+		if err != nil {
+			return nil, err
+		}
+		content = GBk2UTF8(content, contentType)
+		contentStr := site.replaceHost(site.asset.Replace(string(content), replaceTarget{path: request.URL.Path}), requestHost)
+		return []byte(contentStr), nil
+	}
+	htmlCache := site.app.HtmlCache()
+	htmlKey := htmlCacheKey(requestHost, cacheKey)
+	if htmlCache != nil {
+		if content, ok := htmlCache.Get(site, htmlKey, entry.ModTime); ok {
+			markRenderHit(request)
+			return content, nil
+		}
 	}
-	_, err := writer.Write(content)
+	content, err := io.ReadAll(entry.Body)
 	if err != nil {
-		site.app.Logger.Error("写出错误：", err.Error(), request.URL)
+		return nil, err
 	}
+	ua := request.Context().Value(ORIGIN_UA).(string)
+	start := time.Now()
+	content = site.handleHtmlResponse(content, isIndexPage(request.URL), site.isCrawler(ua), contentType, requestHost, request.URL.Path, entry.Response.RandomHtml)
+	elapsed := time.Since(start)
+	addRenderTime(request, elapsed)
+	site.metrics.render.observe(elapsed.Seconds())
+	if htmlCache != nil {
+		htmlCache.Put(site, htmlKey, entry.ModTime, content)
+	}
+	return content, nil
+}
 
+// notModified 客户端的 If-None-Match/If-Modified-Since 是否和缓存匹配
+func notModified(request *http.Request, cacheResponse *CustomResponse) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if cacheResponse.ETag == "" {
+			return false
+		}
+		etag := strings.TrimPrefix(cacheResponse.ETag, "W/")
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince := request.Header.Get("If-Modified-Since"); ifModifiedSince != "" && cacheResponse.LastModified != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(cacheResponse.LastModified)
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(since)
+	}
+	return false
+}
+
+// discardWriter 后台更新缓存时丢弃响应
+type discardWriter struct {
+	header http.Header
 }
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gookit/slog"
+)
+
+func newTestApp(t *testing.T) *Application {
+	t.Helper()
+	app := &Application{Logger: slog.NewWithName("test"), ExpireDate: "2999-01-01"}
+	app.SetConfig(&AppConfig{})
+	app.SetCacheStore(newMemoryCacheStore(1 << 20))
+	return app
+}
+
+func newTestSite(t *testing.T, app *Application, siteConfig *SiteConfig) *Site {
+	t.Helper()
+	if err := validateSiteConfig(siteConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	site, err := newSite(siteConfig, app, app.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Sites.Store(siteConfig.Domain, site)
+	return site
+}
+
+func serveTest(app *Application, method, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, target, nil)
+	request.RemoteAddr = "192.0.2.1:1234"
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// expireCache 把内存缓存的时间往前调，模拟缓存过期
+func expireCache(t *testing.T, app *Application, domain, key string) {
+	t.Helper()
+	store := app.CacheStore().(*memoryCacheStore)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	element, ok := store.items[memoryCacheKey(domain, key)]
+	if !ok {
+		t.Fatalf("%s%s not cached", domain, key)
+	}
+	element.Value.(*memoryCacheItem).modTime = time.Now().Add(-time.Hour)
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	var hits, notModifiedHits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModifiedHits, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png data"))
+	}))
+	defer origin.Close()
+
+	app := newTestApp(t)
+	newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 10})
+
+	//客户端的条件请求不转发给源站，源站要返回完整内容用于缓存
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/a.png", nil)
+	request.Header.Set("If-None-Match", `"v1"`)
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "png data" {
+		t.Fatalf("first request got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if atomic.LoadInt32(&notModifiedHits) != 0 {
+		t.Fatal("client validators should not reach the origin")
+	}
+
+	//缓存未过期，客户端条件请求直接返回304
+	request = httptest.NewRequest(http.MethodGet, "http://example.com/a.png", nil)
+	request.Header.Set("If-None-Match", `W/"v1"`)
+	recorder = httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Fatalf("fresh conditional request got %d %q, want 304", recorder.Code, recorder.Body.String())
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Fatalf("origin hits = %d, want 1", hits)
+	}
+
+	//缓存过期，带 ETag 向源站确认，源站304后用缓存内容响应
+	expireCache(t, app, "example.com", "example.com/a.png")
+	recorder = serveTest(app, http.MethodGet, "http://example.com/a.png")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "png data" {
+		t.Fatalf("revalidated request got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if atomic.LoadInt32(&notModifiedHits) != 1 {
+		t.Fatalf("origin 304 hits = %d, want 1", notModifiedHits)
+	}
+	site, _ := app.querySite("example.com")
+	entry, state := site.openCache("example.com/a.png")
+	if entry == nil || state != cacheFresh {
+		t.Fatal("cache should be fresh again after a 304")
+	}
+	entry.Body.Close()
+
+	//缓存过期且客户端条件请求也匹配，源站304后直接返回304
+	expireCache(t, app, "example.com", "example.com/a.png")
+	request = httptest.NewRequest(http.MethodGet, "http://example.com/a.png", nil)
+	request.Header.Set("If-None-Match", `"v1"`)
+	recorder = httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Fatalf("expired conditional request got %d %q, want 304", recorder.Code, recorder.Body.String())
+	}
+	if atomic.LoadInt32(&notModifiedHits) != 2 {
+		t.Fatalf("origin 304 hits = %d, want 2", notModifiedHits)
+	}
+}
+
+func TestRewrittenContentHasNoValidators(t *testing.T) {
+	var notModifiedHits int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"c1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Header.Get("If-None-Match") == `"c1"` {
+			atomic.AddInt32(&notModifiedHits, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/css")
+		_, _ = w.Write([]byte("body{color:red}"))
+	}))
+	defer origin.Close()
+
+	app := newTestApp(t)
+	newTestSite(t, app, &SiteConfig{Domain: "example.com", Url: origin.URL, CacheEnable: true, CacheTime: 10})
+
+	check := func(name string, recorder *httptest.ResponseRecorder) {
+		t.Helper()
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "body{color:red}" {
+			t.Fatalf("%s got %d %q, want the rewritten body", name, recorder.Code, recorder.Body.String())
+		}
+		if recorder.Header().Get("ETag") != "" || recorder.Header().Get("Last-Modified") != "" {
+			t.Fatalf("%s should not send the origin validators: %v", name, recorder.Header())
+		}
+	}
+	conditional := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "http://example.com/a.css", nil)
+		request.Header.Set("If-None-Match", `"c1"`)
+		request.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+		recorder := httptest.NewRecorder()
+		app.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	check("live", conditional())
+	//改写的内容随规则和配置变化，缓存命中时也不能按源站的 ETag 返回304
+	check("cached", conditional())
+	expireCache(t, app, "example.com", "example.com/a.css")
+	check("revalidated", conditional())
+	if atomic.LoadInt32(&notModifiedHits) != 1 {
+		t.Fatalf("origin 304 hits = %d, want 1", notModifiedHits)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	cacheResponse := &CustomResponse{ETag: `W/"abc"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+	cases := []struct {
+		method string
+		header string
+		value  string
+		want   bool
+	}{
+		{http.MethodGet, "If-None-Match", `"abc"`, true},
+		{http.MethodGet, "If-None-Match", `"x", W/"abc"`, true},
+		{http.MethodGet, "If-None-Match", "*", true},
+		{http.MethodGet, "If-None-Match", `"x"`, false},
+		{http.MethodPost, "If-None-Match", `"abc"`, false},
+		{http.MethodHead, "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", true},
+		{http.MethodGet, "If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", false},
+		{http.MethodGet, "If-Modified-Since", "invalid", false},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(c.method, "http://example.com/", nil)
+		request.Header.Set(c.header, c.value)
+		if got := notModified(request, cacheResponse); got != c.want {
+			t.Errorf("%s %s: %s = %v, want %v", c.method, c.header, c.value, got, c.want)
+		}
+	}
+}
@@ -10,181 +10,341 @@ import (
 )
 
 type SiteConfig struct {
-	Id               int      `json:"id"`
-	Domain           string   `json:"domain"`
-	Url              string   `json:"url"`
-	IndexTitle       string   `json:"index_title"`
-	IndexKeywords    string   `json:"index_keywords"`
-	IndexDescription string   `json:"index_description"`
-	Finds            []string `json:"finds"`
-	Replaces         []string `json:"replaces"`
-	NeedJs           bool     `json:"need_js"`
-	S2t              bool     `json:"s2t"`
-	TitleReplace     bool     `json:"title_replace"`
-	H1Replace        string   `json:"h1replace"`
-	CacheTime        int64    `json:"cache_time"`
-	CacheEnable      bool     `json:"cache_enable"`
-	BaiduPushKey     string   `json:"baidu_push_key"`
-	SmPushKey        string   `json:"sm_push_key"`
+	Id               int            `json:"id"`
+	Domain           string         `json:"domain"`
+	Url              string         `json:"url"`
+	IndexTitle       string         `json:"index_title"`
+	IndexKeywords    string         `json:"index_keywords"`
+	IndexDescription string         `json:"index_description"`
+	Rules            []ReplaceRule  `json:"rules"`
+	HeaderRules      []HeaderRule   `json:"header_rules"`
+	Upstream         UpstreamConfig `json:"upstream"`
+	NeedJs           bool           `json:"need_js"`
+	S2t              bool           `json:"s2t"`
+	TitleReplace     bool           `json:"title_replace"`
+	H1Replace        string         `json:"h1replace"`
+	CacheTime        int64          `json:"cache_time"`
+	CacheEnable      bool           `json:"cache_enable"`
+	BaiduPushKey     string         `json:"baidu_push_key"`
+	SmPushKey        string         `json:"sm_push_key"`
+	StaleTime        int64          `json:"stale_time"`
 }
 
 type Dao struct {
 	*sql.DB
 }
 
+const dbPath = "config/data.db"
+
 func NewDao() (*Dao, error) {
-	db, err := sql.Open("sqlite3", "config/data.db")
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
 	}
 	return &Dao{db}, nil
 }
-func (dao *Dao) GetOne(domain string) (SiteConfig, error) {
-	domain = strings.TrimSpace(domain)
-	var siteConfig SiteConfig
-	rs, err := dao.Query("select id,domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key from website_config where domain=?", domain)
-	if err != nil {
-		return siteConfig, err
-	}
-
-	if rs.Next() {
-		var findsStr, replStr string
-		err = rs.Scan(
-			&siteConfig.Id,
-			&siteConfig.Domain,
-			&siteConfig.Url,
-			&siteConfig.IndexTitle,
-			&siteConfig.IndexKeywords,
-			&siteConfig.IndexDescription,
-			&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t,
-			&siteConfig.CacheEnable, &siteConfig.TitleReplace, &siteConfig.H1Replace,
-			&siteConfig.CacheTime, &siteConfig.BaiduPushKey, &siteConfig.SmPushKey)
-		if err != nil {
-			return siteConfig, err
-		}
-		siteConfig.Finds = strings.Split(findsStr, ";")
-		siteConfig.Replaces = strings.Split(replStr, ";")
 
+// siteColumns finds、replaces 字段已废弃，替换规则保存在 replace_rules 表，响应头规则保存在 header_rules 表
+const siteColumns = "id,domain,url,index_title,index_keywords,index_description,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key,stale_time,upstream"
+
+func scanSite(rs *sql.Rows) (*SiteConfig, error) {
+	siteConfig := &SiteConfig{Rules: make([]ReplaceRule, 0), HeaderRules: make([]HeaderRule, 0)}
+	var upstream string
+	err := rs.Scan(
+		&siteConfig.Id, &siteConfig.Domain, &siteConfig.Url,
+		&siteConfig.IndexTitle, &siteConfig.IndexKeywords, &siteConfig.IndexDescription,
+		&siteConfig.NeedJs, &siteConfig.S2t, &siteConfig.CacheEnable,
+		&siteConfig.TitleReplace, &siteConfig.H1Replace, &siteConfig.CacheTime,
+		&siteConfig.BaiduPushKey, &siteConfig.SmPushKey, &siteConfig.StaleTime, &upstream)
+	if err != nil {
+		return nil, err
 	}
-	err = rs.Close()
+	siteConfig.Upstream, err = decodeUpstream(upstream)
+	return siteConfig, err
+}
+
+// siteRuleTables 按 site_id 保存的站点规则，删除站点时一起删除
+var siteRuleTables = []string{"replace_rules", "header_rules"}
+
+// querySites 查询站点并加载替换规则和响应头规则
+func (dao *Dao) querySites(querySql string, args ...interface{}) ([]*SiteConfig, error) {
+	rs, err := dao.Query(querySql, args...)
 	if err != nil {
-		return siteConfig, err
+		return nil, err
+	}
+	results := make([]*SiteConfig, 0)
+	sites := make(map[int]*SiteConfig)
+	for rs.Next() {
+		siteConfig, err := scanSite(rs)
+		if err != nil {
+			_ = rs.Close()
+			return nil, err
+		}
+		results = append(results, siteConfig)
+		sites[siteConfig.Id] = siteConfig
 	}
-	if siteConfig.Id == 0 {
-		return siteConfig, errors.New("无搜索结果")
+	_ = rs.Close()
+	if len(results) == 0 {
+		return results, nil
 	}
-	return siteConfig, nil
+	where, ruleArgs := siteIdCondition(results)
+	if err = dao.loadRules(sites, where, ruleArgs); err != nil {
+		return nil, err
+	}
+	if err = dao.loadHeaderRules(sites, where, ruleArgs); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
 
+// siteIdCondition 一次查询所有站点时不拼接 in 条件，避免超过sqlite的参数数量限制
+func siteIdCondition(sites []*SiteConfig) (string, []interface{}) {
+	args := make([]interface{}, 0, len(sites))
+	if len(sites) > 500 {
+		return "", args
+	}
+	for _, siteConfig := range sites {
+		args = append(args, siteConfig.Id)
+	}
+	return " where site_id in (?" + strings.Repeat(",?", len(args)-1) + ")", args
 }
-func (dao *Dao) DeleteOne(id int) error {
-	_, err := dao.Exec("delete from website_config where id=?", id)
+
+func (dao *Dao) loadRules(sites map[int]*SiteConfig, where string, args []interface{}) error {
+	rs, err := dao.Query("select id,site_id,sort,find,replacement,match_type,scope,selector,attrs,paths,enabled from replace_rules"+where+" order by site_id,sort,id", args...)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer rs.Close()
+	for rs.Next() {
+		var rule ReplaceRule
+		var scope, attrs, paths string
+		if err = rs.Scan(&rule.Id, &rule.SiteId, &rule.Sort, &rule.Find, &rule.Replace, &rule.MatchType, &scope, &rule.Selector, &attrs, &paths, &rule.Enabled); err != nil {
+			return err
+		}
+		rule.Scopes = strings.Split(scope, ",")
+		rule.Attrs = splitNonEmpty(attrs, ",")
+		rule.Paths = splitNonEmpty(paths, "\n")
+		if siteConfig, ok := sites[rule.SiteId]; ok {
+			siteConfig.Rules = append(siteConfig.Rules, rule)
+		}
+	}
+	return rs.Err()
 }
-func (dao *Dao) GetAll() ([]*SiteConfig, error) {
-	rs, err := dao.Query("select id, domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key from website_config")
+
+func (dao *Dao) loadHeaderRules(sites map[int]*SiteConfig, where string, args []interface{}) error {
+	rs, err := dao.Query("select id,site_id,sort,action,name,value,paths,content_types,enabled from header_rules"+where+" order by site_id,sort,id", args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var results = make([]*SiteConfig, 0)
+	defer rs.Close()
 	for rs.Next() {
-		var siteConfig SiteConfig
-		var findsStr, replStr string
-		err := rs.Scan(
-			&siteConfig.Id, &siteConfig.Domain, &siteConfig.Url,
-			&siteConfig.IndexTitle, &siteConfig.IndexKeywords, &siteConfig.IndexDescription,
-			&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t, &siteConfig.CacheEnable,
-			&siteConfig.TitleReplace, &siteConfig.H1Replace, &siteConfig.CacheTime,
-			&siteConfig.BaiduPushKey, &siteConfig.SmPushKey)
+		var rule HeaderRule
+		var paths, contentTypes string
+		if err = rs.Scan(&rule.Id, &rule.SiteId, &rule.Sort, &rule.Action, &rule.Name, &rule.Value, &paths, &contentTypes, &rule.Enabled); err != nil {
+			return err
+		}
+		rule.Paths = splitNonEmpty(paths, "\n")
+		rule.ContentTypes = splitNonEmpty(contentTypes, ",")
+		if siteConfig, ok := sites[rule.SiteId]; ok {
+			siteConfig.HeaderRules = append(siteConfig.HeaderRules, rule)
+		}
+	}
+	return rs.Err()
+}
+
+func splitNonEmpty(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
+
+// saveSiteRules 整体替换站点的替换规则和响应头规则
+func saveSiteRules(tx *sql.Tx, siteId int, data *SiteConfig) error {
+	if err := saveRules(tx, siteId, data.Rules); err != nil {
+		return err
+	}
+	return saveHeaderRules(tx, siteId, data.HeaderRules)
+}
+
+// saveRules 整体替换站点的替换规则，顺序保存为 sort
+func saveRules(tx *sql.Tx, siteId int, rules []ReplaceRule) error {
+	if _, err := tx.Exec("delete from replace_rules where site_id=?", siteId); err != nil {
+		return err
+	}
+	//路径里可能有 , 用换行分隔
+	insertSql := "insert into replace_rules(site_id,sort,find,replacement,match_type,scope,selector,attrs,paths,enabled)values (?,?,?,?,?,?,?,?,?,?)"
+	for i, rule := range rules {
+		_, err := tx.Exec(insertSql, siteId, i, rule.Find, rule.Replace, rule.MatchType, strings.Join(rule.Scopes, ","),
+			rule.Selector, strings.Join(rule.Attrs, ","), strings.Join(rule.Paths, "\n"), rule.Enabled)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		siteConfig.Finds = strings.Split(findsStr, ";")
-		siteConfig.Replaces = strings.Split(replStr, ";")
-		results = append(results, &siteConfig)
 	}
-	_ = rs.Close()
-	return results, nil
+	return nil
+}
 
+func saveHeaderRules(tx *sql.Tx, siteId int, rules []HeaderRule) error {
+	if _, err := tx.Exec("delete from header_rules where site_id=?", siteId); err != nil {
+		return err
+	}
+	insertSql := "insert into header_rules(site_id,sort,action,name,value,paths,content_types,enabled)values (?,?,?,?,?,?,?,?)"
+	for i, rule := range rules {
+		_, err := tx.Exec(insertSql, siteId, i, rule.Action, rule.Name, rule.Value, strings.Join(rule.Paths, "\n"), strings.Join(rule.ContentTypes, ","), rule.Enabled)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dao *Dao) GetOne(domain string) (SiteConfig, error) {
+	domain = strings.TrimSpace(domain)
+	sites, err := dao.querySites("select "+siteColumns+" from website_config where domain=?", domain)
+	if err != nil {
+		return SiteConfig{}, err
+	}
+	if len(sites) == 0 {
+		return SiteConfig{}, errors.New("无搜索结果")
+	}
+	return *sites[0], nil
+
+}
+func (dao *Dao) GetDomainById(id int) (string, error) {
+	var domain string
+	err := dao.QueryRow("select domain from website_config where id=?", id).Scan(&domain)
+	if err == sql.ErrNoRows {
+		return "", errors.New("无搜索结果")
+	}
+	return domain, err
+}
+func (dao *Dao) DeleteOne(id int) error {
+	tx, err := dao.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range siteRuleTables {
+		if _, err = tx.Exec("delete from "+table+" where site_id=?", id); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec("delete from website_config where id=?", id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+func (dao *Dao) GetAll() ([]*SiteConfig, error) {
+	return dao.querySites("select " + siteColumns + " from website_config")
+
+}
+
+// insertSite 新增站点和替换规则，返回新站点的id
+func insertSite(tx *sql.Tx, data *SiteConfig) (int, error) {
+	insertSql := `insert  into website_config(domain,url,index_title,index_keywords,index_description,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key,stale_time,upstream)values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+	result, err := tx.Exec(insertSql, data.Domain, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription, data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey, data.StaleTime, encodeUpstream(data.Upstream))
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), saveSiteRules(tx, int(id), data)
 }
 func (dao *Dao) addOne(data SiteConfig) error {
-	insertSql := `insert  into website_config(domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key)values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
-	_, err := dao.Exec(insertSql, data.Domain, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription, strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey)
+	tx, err := dao.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	if _, err = insertSite(tx, &data); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 func (dao *Dao) UpdateById(data SiteConfig) error {
-	updateSql := "update website_config set url=?,domain=?,index_title=?,index_keywords=?,index_description=?,finds=?,replaces=?,need_js=?,s2t=?,cache_enable=?,title_replace=?,h1replace=?,cache_time=?,baidu_push_key=?,sm_push_key=? where id=?"
-	_, err := dao.Exec(updateSql, data.Url, data.Domain, data.IndexTitle, data.IndexKeywords, data.IndexDescription, strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey, data.Id)
+	tx, err := dao.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	updateSql := "update website_config set url=?,domain=?,index_title=?,index_keywords=?,index_description=?,need_js=?,s2t=?,cache_enable=?,title_replace=?,h1replace=?,cache_time=?,baidu_push_key=?,sm_push_key=?,stale_time=?,upstream=? where id=?"
+	_, err = tx.Exec(updateSql, data.Url, data.Domain, data.IndexTitle, data.IndexKeywords, data.IndexDescription, data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey, data.StaleTime, encodeUpstream(data.Upstream), data.Id)
+	if err == nil {
+		err = saveSiteRules(tx, data.Id, &data)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 
 }
 func (dao *Dao) GetByPage(page, limit int) ([]SiteConfig, error) {
 	start := (page - 1) * limit
-	querySql := fmt.Sprintf("select * from website_config limit %d,%d", start, limit)
-	rs, err := dao.Query(querySql)
+	querySql := fmt.Sprintf("select %s from website_config limit %d,%d", siteColumns, start, limit)
+	sites, err := dao.querySites(querySql)
 	if err != nil {
 		return nil, err
 	}
-	var results = make([]SiteConfig, 0)
-	for rs.Next() {
-		var siteConfig SiteConfig
-		var findsStr, replStr string
-		err := rs.Scan(
-			&siteConfig.Id, &siteConfig.Domain, &siteConfig.Url,
-			&siteConfig.IndexTitle, &siteConfig.IndexKeywords, &siteConfig.IndexDescription,
-			&findsStr, &replStr, &siteConfig.NeedJs, &siteConfig.S2t, &siteConfig.CacheEnable,
-			&siteConfig.TitleReplace, &siteConfig.H1Replace, &siteConfig.CacheTime,
-			&siteConfig.BaiduPushKey, &siteConfig.SmPushKey)
-		if err != nil {
-			return nil, err
-		}
-		siteConfig.Finds = strings.Split(findsStr, ";")
-		siteConfig.Replaces = strings.Split(replStr, ";")
-
-		results = append(results, siteConfig)
+	var results = make([]SiteConfig, 0, len(sites))
+	for _, siteConfig := range sites {
+		results = append(results, *siteConfig)
 	}
-	_ = rs.Close()
 	return results, nil
 }
-func (dao *Dao) AddMulti(configs []*SiteConfig) error {
+
+// ImportMulti 在一个事务里新增 adds 并按域名更新 updates
+func (dao *Dao) ImportMulti(adds, updates []*SiteConfig) error {
 	tx, err := dao.Begin()
 	if err != nil {
 		return err
 	}
-	insetSql := `insert into website_config(domain,url,index_title,index_keywords,index_description,finds,replaces,need_js,s2t,cache_enable,title_replace,h1replace,cache_time,baidu_push_key,sm_push_key)values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
-	for _, data := range configs {
-		_, err := tx.Exec(insetSql, data.Domain, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription, strings.Join(data.Finds, ";"), strings.Join(data.Replaces, ";"), data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey)
-		if err != nil {
+	for _, data := range adds {
+		if _, err := insertSite(tx, data); err != nil {
 			_ = tx.Rollback()
-			return err
+			return fmt.Errorf("%s: %w", data.Domain, err)
 		}
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
+	updateSql := "update website_config set url=?,index_title=?,index_keywords=?,index_description=?,need_js=?,s2t=?,cache_enable=?,title_replace=?,h1replace=?,cache_time=?,baidu_push_key=?,sm_push_key=?,stale_time=?,upstream=? where domain=?"
+	for _, data := range updates {
+		var id int
+		err := tx.QueryRow("select id from website_config where domain=?", data.Domain).Scan(&id)
+		if err == nil {
+			_, err = tx.Exec(updateSql, data.Url, data.IndexTitle, data.IndexKeywords, data.IndexDescription, data.NeedJs, data.S2t, data.CacheEnable, data.TitleReplace, data.H1Replace, data.CacheTime, data.BaiduPushKey, data.SmPushKey, data.StaleTime, encodeUpstream(data.Upstream), data.Domain)
+		}
+		if err == nil {
+			err = saveSiteRules(tx, id, data)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%s: %w", data.Domain, err)
+		}
 	}
-	return nil
-
+	return tx.Commit()
 }
 func (dao *Dao) MultiDel(domains []string) error {
 	args := make([]interface{}, len(domains))
 	for i, id := range domains {
 		args[i] = id
 	}
-	delSql := `delete from website_config where domain in (?` + strings.Repeat(",?", len(args)-1) + `)`
-	_, err := dao.Exec(delSql, args...)
+	in := `(?` + strings.Repeat(",?", len(args)-1) + `)`
+	tx, err := dao.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	for _, table := range siteRuleTables {
+		if _, err = tx.Exec(`delete from `+table+` where site_id in (select id from website_config where domain in `+in+`)`, args...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec(`delete from website_config where domain in `+in, args...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 
 }
 
@@ -207,7 +367,15 @@ func (dao *Dao) Count() (int, error) {
 	return count, nil
 
 }
-func (dao *Dao) ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord string) ([]string, error) {
+
+// TitleChange 禁词替换修改的首页标题
+type TitleChange struct {
+	Domain   string
+	OldTitle string
+	NewTitle string
+}
+
+func (dao *Dao) ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord string) ([]TitleChange, error) {
 	forbiddenSql := "select domain,index_title from website_config where index_title like ?"
 	rs, err := dao.Query(forbiddenSql, "%"+forbiddenWord+"%")
 	if err != nil {
@@ -217,12 +385,9 @@ func (dao *Dao) ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord strin
 	var temp string
 	var tempDomain string
 	for rs.Next() {
-		err = rs.Scan(&tempDomain)
-		if err != nil {
-			return nil, err
-		}
-		err = rs.Scan(&temp)
+		err = rs.Scan(&tempDomain, &temp)
 		if err != nil {
+			_ = rs.Close()
 			return nil, err
 		}
 		indexTitleArr[tempDomain] = temp
@@ -231,8 +396,8 @@ func (dao *Dao) ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord strin
 	if len(indexTitleArr) == 0 {
 		return nil, errors.New("没有找到要替换的禁词")
 	}
-	var domainArr = make([]string, 0)
-	updateSql := `update website_config set index_title=? where index_title=?`
+	var changes = make([]TitleChange, 0)
+	updateSql := `update website_config set index_title=? where domain=?`
 	for domain, title := range indexTitleArr {
 		if strings.Contains(title, forbiddenWord+splitWord) || strings.Contains(title, splitWord+forbiddenWord) {
 			words := strings.Split(title, splitWord)
@@ -242,58 +407,352 @@ func (dao *Dao) ForbiddenWordReplace(forbiddenWord, replaceWord, splitWord strin
 				}
 			}
 			newTitle := strings.Join(words, splitWord)
-			_, err := dao.Exec(updateSql, newTitle, title)
+			_, err := dao.Exec(updateSql, newTitle, domain)
 			if err != nil {
 				return nil, err
 			}
-			dn := domain + "##" + newTitle
-			domainArr = append(domainArr, dn)
+			changes = append(changes, TitleChange{Domain: domain, OldTitle: title, NewTitle: newTitle})
+		}
+	}
+	return changes, err
+}
+func (dao *Dao) AddRecords(records []*AccessRecord) error {
+	tx, err := dao.Begin()
+	if err != nil {
+		return err
+	}
+	insertSql := `insert into access_record(domain,path,status,cache_hit,spider,user_agent,latency,render_hit,render_time,created_time)values (?,?,?,?,?,?,?,?,?,?)`
+	for _, record := range records {
+		_, err := tx.Exec(insertSql, record.Domain, record.Path, record.Status, record.CacheHit, record.Spider, record.UserAgent, record.Latency, record.RenderHit, record.RenderTime, record.CreatedTime)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
 		}
 	}
-	return domainArr, err
+	return tx.Commit()
 }
 
-func InitTable() error {
-	db, err := sql.Open("sqlite3", "config/data.db")
+// recordCondition 根据域名和时间范围拼接查询条件，时间为0表示不限制
+func recordCondition(domain string, startTime, endTime int64) (string, []interface{}) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if domain != "" {
+		conditions = append(conditions, "(domain=? or domain like ?)")
+		args = append(args, domain, "%."+domain)
+	}
+	if startTime > 0 {
+		conditions = append(conditions, "created_time>=?")
+		args = append(args, startTime)
+	}
+	if endTime > 0 {
+		conditions = append(conditions, "created_time<=?")
+		args = append(args, endTime)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " where " + strings.Join(conditions, " and "), args
+}
+func (dao *Dao) GetRecordByPage(page, limit int, domain string, startTime, endTime int64) ([]AccessRecord, error) {
+	where, args := recordCondition(domain, startTime, endTime)
+	start := (page - 1) * limit
+	querySql := fmt.Sprintf("select id,domain,path,status,cache_hit,spider,user_agent,latency,render_hit,render_time,created_time from access_record%s order by id desc limit %d,%d", where, start, limit)
+	rs, err := dao.Query(querySql, args...)
+	if err != nil {
+		return nil, err
+	}
+	var results = make([]AccessRecord, 0)
+	for rs.Next() {
+		var record AccessRecord
+		err := rs.Scan(&record.Id, &record.Domain, &record.Path, &record.Status, &record.CacheHit,
+			&record.Spider, &record.UserAgent, &record.Latency, &record.RenderHit, &record.RenderTime, &record.CreatedTime)
+		if err != nil {
+			_ = rs.Close()
+			return nil, err
+		}
+		results = append(results, record)
+	}
+	_ = rs.Close()
+	return results, nil
+}
+func (dao *Dao) CountRecord(domain string, startTime, endTime int64) (int, error) {
+	where, args := recordCondition(domain, startTime, endTime)
+	var count int
+	err := dao.QueryRow("select count(*) as count from access_record"+where, args...).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// RecordStats 按域名汇总访问量、缓存命中和耗时，按访问量倒序
+func (dao *Dao) RecordStats(domain string, startTime, endTime int64, limit int) ([]RecordStat, error) {
+	where, args := recordCondition(domain, startTime, endTime)
+	querySql := fmt.Sprintf(`select domain,count(*),sum(cache_hit),sum(render_hit),avg(latency),max(latency),avg(render_time),sum(render_time)
+	from access_record%s group by domain order by count(*) desc limit %d`, where, limit)
+	rs, err := dao.Query(querySql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var results = make([]RecordStat, 0)
+	for rs.Next() {
+		var stat RecordStat
+		err := rs.Scan(&stat.Domain, &stat.Count, &stat.CacheHits, &stat.RenderHits, &stat.AvgLatency, &stat.MaxLatency, &stat.AvgRender, &stat.TotalRender)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, stat)
+	}
+	return results, rs.Err()
+}
+func (dao *Dao) DeleteRecord(startTime, endTime int64) (int64, error) {
+	result, err := dao.Exec("delete from access_record where created_time>=? and created_time<=?", startTime, endTime)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (dao *Dao) CountUser() (int, error) {
+	var count int
+	err := dao.QueryRow("select count(*) from admin_user").Scan(&count)
+	return count, err
+}
+
+// GetUser 返回用户和分配的域名，用户不存在返回 sql.ErrNoRows
+func (dao *Dao) GetUser(userName string) (*AdminAccount, error) {
+	return dao.getUser("user_name=?", userName)
+}
+func (dao *Dao) GetUserById(id int) (*AdminAccount, error) {
+	return dao.getUser("id=?", id)
+}
+func (dao *Dao) getUser(where string, arg interface{}) (*AdminAccount, error) {
+	account := &AdminAccount{}
+	err := dao.QueryRow("select id,user_name,password_hash,role,created_time from admin_user where "+where, arg).
+		Scan(&account.Id, &account.UserName, &account.PasswordHash, &account.Role, &account.CreatedTime)
+	if err != nil {
+		return nil, err
+	}
+	account.Domains, err = dao.getUserDomains(account.Id)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+func (dao *Dao) getUserDomains(userId int) ([]string, error) {
+	rs, err := dao.Query("select domain from admin_user_domain where user_id=? order by domain", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	domains := make([]string, 0)
+	for rs.Next() {
+		var domain string
+		if err = rs.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rs.Err()
+}
+func (dao *Dao) GetUsers() ([]*AdminAccount, error) {
+	rs, err := dao.Query("select id,user_name,role,created_time from admin_user order by id")
+	if err != nil {
+		return nil, err
+	}
+	accounts := make([]*AdminAccount, 0)
+	for rs.Next() {
+		account := &AdminAccount{}
+		if err = rs.Scan(&account.Id, &account.UserName, &account.Role, &account.CreatedTime); err != nil {
+			_ = rs.Close()
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	_ = rs.Close()
+	for _, account := range accounts {
+		if account.Domains, err = dao.getUserDomains(account.Id); err != nil {
+			return nil, err
+		}
+	}
+	return accounts, nil
+}
+
+// SaveUser Id为0时新增，PasswordHash为空时不修改密码，分配的域名整体替换
+func (dao *Dao) SaveUser(account *AdminAccount) error {
+	tx, err := dao.Begin()
 	if err != nil {
 		return err
 	}
-	err = createSiteTable(db)
+	if account.Id == 0 {
+		result, err := tx.Exec("insert into admin_user(user_name,password_hash,role,created_time)values(?,?,?,?)",
+			account.UserName, account.PasswordHash, account.Role, account.CreatedTime)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		account.Id = int(id)
+	} else {
+		_, err = tx.Exec("update admin_user set role=? where id=?", account.Role, account.Id)
+		if err == nil && account.PasswordHash != "" {
+			_, err = tx.Exec("update admin_user set password_hash=? where id=?", account.PasswordHash, account.Id)
+		}
+		if err == nil {
+			_, err = tx.Exec("delete from admin_user_domain where user_id=?", account.Id)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	for _, domain := range account.Domains {
+		if _, err = tx.Exec("insert or ignore into admin_user_domain(user_id,domain)values(?,?)", account.Id, domain); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+func (dao *Dao) SetUserPassword(userName, passwordHash string) (int64, error) {
+	result, err := dao.Exec("update admin_user set password_hash=? where user_name=?", passwordHash, userName)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+func (dao *Dao) DeleteUser(id int) error {
+	tx, err := dao.Begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	if _, err = tx.Exec("delete from admin_user_domain where user_id=?", id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("delete from api_token where user_id=?", id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("delete from admin_user where id=?", id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func createSiteTable(db *sql.DB) error {
-	rs, err := db.Query(`SELECT count(*) as count FROM sqlite_master WHERE type='table' AND name = 'website_config'`)
+func (dao *Dao) AddToken(token *ApiToken, tokenHash string) error {
+	result, err := dao.Exec("insert into api_token(user_id,name,token_hash,created_time,last_used_time)values (?,?,?,?,0)",
+		token.UserId, token.Name, tokenHash, token.CreatedTime)
 	if err != nil {
 		return err
 	}
-	var count int
-	rs.Next()
-	rs.Scan(&count)
-	rs.Close()
-	if count == 0 {
-		_, err = db.Exec(`create table if not exists website_config  (
-		id integer primary key AUTOINCREMENT,
-		domain varchar(30) not null unique ,
-		url varchar(50),
-		index_title varchar(50),
-		index_keywords varchar(100),
-		index_description varchar(255),
-		finds varchar(100),
-		replaces varchar(100),
-		need_js boolean default false ,
-		s2t boolean default false ,
-		cache_enable boolean default true,
-		title_replace boolean default false ,
-		h1replace varchar(20),
-		cache_time integer,
-		baidu_push_key varchar(255),
-		sm_push_key varchar(255)	
-)`)
+	id, err := result.LastInsertId()
+	token.Id = int(id)
+	return err
+}
+
+// GetTokenUser 返回令牌对应的用户并更新最后使用时间
+func (dao *Dao) GetTokenUser(tokenHash string, now int64) (*AdminAccount, error) {
+	var userId int
+	err := dao.QueryRow("select user_id from api_token where token_hash=?", tokenHash).Scan(&userId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dao.Exec("update api_token set last_used_time=? where token_hash=?", now, tokenHash); err != nil {
+		return nil, err
+	}
+	return dao.GetUserById(userId)
+}
+func (dao *Dao) GetTokens(userId int) ([]ApiToken, error) {
+	rs, err := dao.Query("select id,user_id,name,created_time,last_used_time from api_token where user_id=? order by id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var results = make([]ApiToken, 0)
+	for rs.Next() {
+		var token ApiToken
+		if err := rs.Scan(&token.Id, &token.UserId, &token.Name, &token.CreatedTime, &token.LastUsedTime); err != nil {
+			return nil, err
+		}
+		results = append(results, token)
+	}
+	return results, rs.Err()
+}
 
+// DeleteToken 只能删除自己的令牌，返回删除的行数
+func (dao *Dao) DeleteToken(id, userId int) (int64, error) {
+	result, err := dao.Exec("delete from api_token where id=? and user_id=?", id, userId)
+	if err != nil {
+		return 0, err
 	}
+	return result.RowsAffected()
+}
+
+func (dao *Dao) AddAudit(log *AuditLog) error {
+	_, err := dao.Exec(`insert into audit_log(user_name,action,domain,before_json,after_json,ip,created_time)values (?,?,?,?,?,?,?)`,
+		log.UserName, log.Action, log.Domain, log.Before, log.After, log.Ip, log.CreatedTime)
 	return err
 }
+
+// auditCondition 按域名和操作类型拼接查询条件，域名包括子域名
+func auditCondition(domain, action string) (string, []interface{}) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if domain != "" {
+		conditions = append(conditions, "(domain=? or domain like ?)")
+		args = append(args, domain, "%."+domain)
+	}
+	if action != "" {
+		conditions = append(conditions, "action=?")
+		args = append(args, action)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " where " + strings.Join(conditions, " and "), args
+}
+func (dao *Dao) GetAuditByPage(page, limit int, domain, action string) ([]AuditLog, error) {
+	where, args := auditCondition(domain, action)
+	start := (page - 1) * limit
+	querySql := fmt.Sprintf("select id,user_name,action,domain,before_json,after_json,ip,created_time from audit_log%s order by id desc limit %d,%d", where, start, limit)
+	rs, err := dao.Query(querySql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var results = make([]AuditLog, 0)
+	for rs.Next() {
+		var log AuditLog
+		err := rs.Scan(&log.Id, &log.UserName, &log.Action, &log.Domain, &log.Before, &log.After, &log.Ip, &log.CreatedTime)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, log)
+	}
+	return results, rs.Err()
+}
+func (dao *Dao) CountAudit(domain, action string) (int, error) {
+	where, args := auditCondition(domain, action)
+	var count int
+	err := dao.QueryRow("select count(*) as count from audit_log"+where, args...).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+func (dao *Dao) GetAudit(id int64) (*AuditLog, error) {
+	var log AuditLog
+	err := dao.QueryRow("select id,user_name,action,domain,before_json,after_json,ip,created_time from audit_log where id=?", id).
+		Scan(&log.Id, &log.UserName, &log.Action, &log.Domain, &log.Before, &log.After, &log.Ip, &log.CreatedTime)
+	if err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	defaultCertDir      = "config/certs"
+	defaultAcmeCacheDir = "config/acme"
+)
+
+// certStore 按证书里的域名(包括 *.example.com)索引证书目录里的证书。
+// 目录里的 名称.crt 和 名称.key 为一对，子目录里的 fullchain.pem 和 privkey.pem 为一对，文件名不影响匹配
+type certStore struct {
+	lock      sync.RWMutex
+	signature string
+	certs     map[string]*tls.Certificate
+}
+
+func newCertStore() *certStore {
+	return &certStore{certs: make(map[string]*tls.Certificate)}
+}
+
+// certPairs 找出目录里的证书和私钥文件
+func certPairs(dir string) ([][2]string, error) {
+	pairs := make([][2]string, 0)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".crt"):
+			pairs = append(pairs, [2]string{path, strings.TrimSuffix(path, ".crt") + ".key"})
+		case name == "fullchain.pem":
+			pairs = append(pairs, [2]string{path, filepath.Join(filepath.Dir(path), "privkey.pem")})
+		}
+		return nil
+	})
+	return pairs, err
+}
+
+// dirSignature 目录里证书文件的名称、大小和修改时间，没有变化时不用重新加载
+func dirSignature(dir string, pairs [][2]string) string {
+	var builder strings.Builder
+	builder.WriteString(dir)
+	for _, pair := range pairs {
+		for _, path := range pair {
+			info, err := os.Stat(path)
+			if err != nil {
+				fmt.Fprintf(&builder, "\n%s", path)
+				continue
+			}
+			fmt.Fprintf(&builder, "\n%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return builder.String()
+}
+
+// Load 读取证书目录，文件没有变化时不重新读取。单个证书错误时跳过，其他证书正常使用
+func (store *certStore) Load(dir string) ([]string, error) {
+	if dir == "" {
+		dir = defaultCertDir
+	}
+	pairs, err := certPairs(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	signature := dirSignature(dir, pairs)
+	store.lock.RLock()
+	unchanged := signature == store.signature
+	store.lock.RUnlock()
+	if unchanged {
+		return nil, nil
+	}
+	warnings := make([]string, 0)
+	certs := make(map[string]*tls.Certificate)
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("证书 %s 读取失败: %s", pair[0], err.Error()))
+			continue
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("证书 %s 解析失败: %s", pair[0], err.Error()))
+			continue
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			//同一个域名有多个证书时使用过期时间最晚的
+			if old, ok := certs[name]; ok && old.Leaf.NotAfter.After(leaf.NotAfter) {
+				continue
+			}
+			certs[name] = &cert
+		}
+	}
+	store.lock.Lock()
+	store.signature = signature
+	store.certs = certs
+	store.lock.Unlock()
+	return warnings, nil
+}
+
+// get 先找完全相同的域名，再找上一级的通配符证书
+func (store *certStore) get(serverName string) *tls.Certificate {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if cert, ok := store.certs[serverName]; ok {
+		return cert
+	}
+	if index := strings.IndexByte(serverName, '.'); index > 0 {
+		if cert, ok := store.certs["*"+serverName[index:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// newAcmeManager 证书目录里没有对应证书时通过 ACME 申请，只给已配置的站点申请
+func (app *Application) newAcmeManager(appConfig *AppConfig) (*autocert.Manager, error) {
+	cacheDir := appConfig.AcmeCacheDir
+	if cacheDir == "" {
+		cacheDir = defaultAcmeCacheDir
+	}
+	client := &acme.Client{DirectoryURL: appConfig.AcmeDirectory}
+	if appConfig.AcmeCaFile != "" {
+		//测试用的 ACME 服务使用自己的根证书
+		data, err := os.ReadFile(appConfig.AcmeCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("acme_ca_file %s 里没有证书", appConfig.AcmeCaFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		Email:  appConfig.AcmeEmail,
+		Client: client,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if net.ParseIP(host) != nil {
+				return errors.New("不能给IP申请证书")
+			}
+			_, err := app.querySite(host)
+			return err
+		},
+	}, nil
+}
+
+// getCertificate 按 SNI 选择证书，证书目录优先，找不到时使用 ACME
+func (app *Application) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if app.acme != nil {
+		//tls-alpn-01 验证请求交给 ACME 处理
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return app.acme.GetCertificate(hello)
+			}
+		}
+	}
+	if cert := app.certs.get(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if app.acme != nil && hello.ServerName != "" {
+		return app.acme.GetCertificate(hello)
+	}
+	return nil, fmt.Errorf("没有 %s 的证书", hello.ServerName)
+}
+
+// startCertWatcher 定时检查证书目录，证书更新后不用重启
+func (app *Application) startCertWatcher() {
+	app.certStop = make(chan struct{})
+	app.certDone = make(chan struct{})
+	go func() {
+		defer close(app.certDone)
+		for {
+			interval := time.Duration(app.Config().TlsReloadInterval) * time.Second
+			if interval <= 0 {
+				interval = 30 * time.Second
+			}
+			timer := time.NewTimer(interval)
+			select {
+			case <-app.certStop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				app.loadCerts()
+			}
+		}
+	}()
+}
+
+func (app *Application) stopCertWatcher() {
+	if app.certStop == nil {
+		return
+	}
+	close(app.certStop)
+	<-app.certDone
+	app.certStop = nil
+}
+
+func (app *Application) loadCerts() {
+	warnings, err := app.certs.Load(app.Config().TlsCertDir)
+	if err != nil {
+		app.Logger.Error("读取证书目录错误", err.Error())
+		return
+	}
+	for _, warning := range warnings {
+		app.Logger.Warn(warning)
+	}
+}
+
+// startTls 监听 tls_port，由程序自己处理 HTTPS，不需要前面的 nginx
+func (app *Application) startTls(appConfig *AppConfig) error {
+	app.certs = newCertStore()
+	app.loadCerts()
+	if appConfig.AcmeEnable {
+		manager, err := app.newAcmeManager(appConfig)
+		if err != nil {
+			return err
+		}
+		app.acme = manager
+	}
+	l, err := net.Listen("tcp", ":"+appConfig.TlsPort)
+	if err != nil {
+		return err
+	}
+	l = netutil.LimitListener(l, 256*2048)
+	tlsConfig := &tls.Config{GetCertificate: app.getCertificate, MinVersion: tls.VersionTLS12}
+	if app.acme != nil {
+		tlsConfig.NextProtos = []string{acme.ALPNProto}
+	}
+	app.TlsServer = &http.Server{Handler: app, TLSConfig: tlsConfig}
+	if appConfig.Http2 {
+		if err = http2.ConfigureServer(app.TlsServer, &http2.Server{}); err != nil {
+			_ = l.Close()
+			return err
+		}
+	} else {
+		//TLSNextProto 不为nil时标准库不会自动开启HTTP/2
+		app.TlsServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	app.startCertWatcher()
+	go func() {
+		if err := app.TlsServer.ServeTLS(l, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Fatalln("监听错误" + err.Error())
+			os.Exit(1)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,258 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	CookiePass  = "pass"
+	CookieStrip = "strip"
+
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+
+	BalanceFailover     = "failover"
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastLatency = "least_latency"
+
+	//接口、导出和操作记录里代替密码和令牌，保存时换回原来的值
+	secretMask = "******"
+)
+
+// 回源请求不能通过 headers 修改的请求头
+var reservedUpstreamHeaders = map[string]bool{"Host": true, "Content-Length": true, "Transfer-Encoding": true, "Connection": true, "Upgrade": true, "Te": true, "Trailer": true}
+
+// UpstreamConfig 站点回源请求的设置
+type UpstreamConfig struct {
+	//额外的请求头，覆盖客户端的同名请求头
+	Headers map[string]string `json:"headers,omitempty"`
+	//为空时使用全局的 user_agent
+	UserAgent      string `json:"user_agent,omitempty"`
+	AcceptLanguage string `json:"accept_language,omitempty"`
+	//pass 转发客户端的 Cookie，strip 不转发，headers 里的 Cookie 不受影响
+	CookiePolicy string `json:"cookie_policy,omitempty"`
+	//basic、bearer，为空时不认证
+	AuthType     string `json:"auth_type,omitempty"`
+	AuthUser     string `json:"auth_user,omitempty"`
+	AuthPassword string `json:"auth_password,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+	//健康检查的路径，为空时不检查
+	HealthPath string `json:"health_path,omitempty"`
+	//健康检查间隔秒数，默认10
+	HealthInterval int64 `json:"health_interval,omitempty"`
+	//同时连接源站的最大连接数，0不限制
+	MaxConns int `json:"max_conns,omitempty"`
+	//连续失败多少次后熔断，0不熔断
+	BreakerFailures int `json:"breaker_failures,omitempty"`
+	//熔断多少秒后试探源站，默认30
+	BreakerTimeout int64 `json:"breaker_timeout,omitempty"`
+	//镜像地址之外内容相同的源站
+	Origins []string `json:"origins,omitempty"`
+	//failover 镜像地址优先，不可用时按顺序使用其他源站；round_robin 轮流使用；least_latency 使用响应最快的
+	Balance string `json:"balance,omitempty"`
+}
+
+// upstreamRecord 数据库里保存的回源设置，不隐藏密码和令牌
+type upstreamRecord UpstreamConfig
+
+// MarshalJSON 密码和令牌输出为 secretMask
+func (upstream UpstreamConfig) MarshalJSON() ([]byte, error) {
+	record := upstreamRecord(upstream)
+	if record.AuthPassword != "" {
+		record.AuthPassword = secretMask
+	}
+	if record.AuthToken != "" {
+		record.AuthToken = secretMask
+	}
+	return json.Marshal(record)
+}
+
+// encodeUpstream 保存到 website_config.upstream 的JSON，没有设置时为空
+func encodeUpstream(upstream UpstreamConfig) string {
+	if upstream.isZero() {
+		return ""
+	}
+	data, _ := json.Marshal(upstreamRecord(upstream))
+	return string(data)
+}
+
+func decodeUpstream(data string) (UpstreamConfig, error) {
+	var record upstreamRecord
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			return UpstreamConfig{}, fmt.Errorf("回源设置错误: %w", err)
+		}
+	}
+	return UpstreamConfig(record), nil
+}
+
+func (upstream *UpstreamConfig) isZero() bool {
+	return len(upstream.Headers) == 0 && upstream.UserAgent == "" && upstream.AcceptLanguage == "" &&
+		(upstream.CookiePolicy == "" || upstream.CookiePolicy == CookiePass) && upstream.AuthType == "" &&
+		upstream.HealthPath == "" && upstream.HealthInterval == 0 && upstream.MaxConns == 0 && upstream.BreakerFailures == 0 && upstream.BreakerTimeout == 0 &&
+		len(upstream.Origins) == 0 && (upstream.Balance == "" || upstream.Balance == BalanceFailover)
+}
+
+// keepSecrets 密码和令牌是 secretMask 时使用 before 里原来的值。导出和操作记录里的密码和令牌是隐藏的，
+// 没有原来的值(新域名)时返回错误，不能保存成空密码
+func (upstream *UpstreamConfig) keepSecrets(before *UpstreamConfig) error {
+	if upstream.AuthPassword == secretMask {
+		if before == nil || before.AuthPassword == "" {
+			return errors.New("回源密码是隐藏的 ******，没有原来的密码可以沿用，请填写实际的密码")
+		}
+		upstream.AuthPassword = before.AuthPassword
+	}
+	if upstream.AuthToken == secretMask {
+		if before == nil || before.AuthToken == "" {
+			return errors.New("回源令牌是隐藏的 ******，没有原来的令牌可以沿用，请填写实际的令牌")
+		}
+		upstream.AuthToken = before.AuthToken
+	}
+	return nil
+}
+
+// validateUpstream 检查回源设置，请求头名称转成标准格式
+func validateUpstream(upstream *UpstreamConfig) error {
+	headers := make(map[string]string, len(upstream.Headers))
+	for name, value := range upstream.Headers {
+		name = strings.TrimSpace(name)
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("回源请求头名称 %s 错误", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if reservedUpstreamHeaders[name] || name == "Authorization" && upstream.AuthType != "" {
+			return fmt.Errorf("回源请求头不能设置 %s", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("回源请求头 %s 的值错误", name)
+		}
+		headers[name] = value
+	}
+	upstream.Headers = headers
+	if len(upstream.Headers) == 0 {
+		upstream.Headers = nil
+	}
+	upstream.UserAgent = strings.TrimSpace(upstream.UserAgent)
+	upstream.AcceptLanguage = strings.TrimSpace(upstream.AcceptLanguage)
+	if !httpguts.ValidHeaderFieldValue(upstream.UserAgent) || !httpguts.ValidHeaderFieldValue(upstream.AcceptLanguage) {
+		return errors.New("回源 User-Agent 或 Accept-Language 错误")
+	}
+	if upstream.CookiePolicy == "" {
+		upstream.CookiePolicy = CookiePass
+	}
+	if upstream.CookiePolicy != CookiePass && upstream.CookiePolicy != CookieStrip {
+		return fmt.Errorf("Cookie 策略 %s 错误", upstream.CookiePolicy)
+	}
+	switch upstream.AuthType {
+	case "":
+		upstream.AuthUser, upstream.AuthPassword, upstream.AuthToken = "", "", ""
+	case AuthBasic:
+		if upstream.AuthUser == "" || strings.Contains(upstream.AuthUser, ":") {
+			return errors.New("basic 认证的用户名不能为空且不能包含:")
+		}
+		upstream.AuthToken = ""
+	case AuthBearer:
+		if upstream.AuthToken == "" || !httpguts.ValidHeaderFieldValue(upstream.AuthToken) {
+			return errors.New("bearer 认证的令牌错误")
+		}
+		upstream.AuthUser, upstream.AuthPassword = "", ""
+	default:
+		return fmt.Errorf("认证方式 %s 错误", upstream.AuthType)
+	}
+	upstream.HealthPath = strings.TrimSpace(upstream.HealthPath)
+	if upstream.HealthPath != "" && (!strings.HasPrefix(upstream.HealthPath, "/") || strings.ContainsAny(upstream.HealthPath, " \t\n")) {
+		return errors.New("健康检查路径必须以/开头且不能包含空白")
+	}
+	if upstream.HealthInterval < 0 || upstream.MaxConns < 0 || upstream.BreakerFailures < 0 || upstream.BreakerTimeout < 0 {
+		return errors.New("健康检查间隔、最大连接数和熔断配置不能小于0")
+	}
+	origins := make([]string, 0, len(upstream.Origins))
+	for _, origin := range upstream.Origins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("源站 %s 格式错误，需要 http:// 或 https:// 开头", origin)
+		}
+		for _, exist := range origins {
+			if exist == origin {
+				return fmt.Errorf("源站 %s 重复", origin)
+			}
+		}
+		origins = append(origins, origin)
+	}
+	upstream.Origins = origins
+	if len(upstream.Origins) == 0 {
+		upstream.Origins = nil
+	}
+	if upstream.Balance == "" {
+		upstream.Balance = BalanceFailover
+	}
+	if upstream.Balance != BalanceFailover && upstream.Balance != BalanceRoundRobin && upstream.Balance != BalanceLeastLatency {
+		return fmt.Errorf("源站选择方式 %s 错误", upstream.Balance)
+	}
+	return nil
+}
+
+// parseHeaderLines 读取后台每行一个的 Name: value
+func parseHeaderLines(text string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		index := strings.IndexByte(line, ':')
+		if index <= 0 {
+			return nil, fmt.Errorf("回源请求头 %s 格式错误，需要 名称: 值", line)
+		}
+		headers[strings.TrimSpace(line[:index])] = strings.TrimSpace(line[index+1:])
+	}
+	return headers, nil
+}
+
+func formatHeaderLines(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, name+": "+headers[name])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// applyUpstream 在 Director 之后修改回源请求
+func (site *Site) applyUpstream(req *http.Request) {
+	upstream := &site.Upstream
+	if upstream.UserAgent != "" {
+		req.Header.Set("User-Agent", upstream.UserAgent)
+	}
+	if upstream.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", upstream.AcceptLanguage)
+	}
+	if upstream.CookiePolicy == CookieStrip {
+		req.Header.Del("Cookie")
+	}
+	for name, value := range upstream.Headers {
+		req.Header.Set(name, value)
+	}
+	switch upstream.AuthType {
+	case AuthBasic:
+		req.SetBasicAuth(upstream.AuthUser, upstream.AuthPassword)
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+upstream.AuthToken)
+	}
+}
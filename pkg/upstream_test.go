@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestValidateUpstream(t *testing.T) {
+	cases := []struct {
+		name     string
+		upstream UpstreamConfig
+		valid    bool
+	}{
+		{"empty", UpstreamConfig{}, true},
+		{"header", UpstreamConfig{Headers: map[string]string{" x-token ": "abc"}}, true},
+		{"bad header name", UpstreamConfig{Headers: map[string]string{"x token": "abc"}}, false},
+		{"bad header value", UpstreamConfig{Headers: map[string]string{"X-Token": "a\nb"}}, false},
+		{"reserved header", UpstreamConfig{Headers: map[string]string{"host": "a.com"}}, false},
+		{"authorization without auth", UpstreamConfig{Headers: map[string]string{"Authorization": "x"}}, true},
+		{"authorization with auth", UpstreamConfig{Headers: map[string]string{"Authorization": "x"}, AuthType: AuthBearer, AuthToken: "t"}, false},
+		{"bad user agent", UpstreamConfig{UserAgent: "a\nb"}, false},
+		{"cookie strip", UpstreamConfig{CookiePolicy: CookieStrip}, true},
+		{"bad cookie policy", UpstreamConfig{CookiePolicy: "drop"}, false},
+		{"basic", UpstreamConfig{AuthType: AuthBasic, AuthUser: "user", AuthPassword: "pass"}, true},
+		{"basic without user", UpstreamConfig{AuthType: AuthBasic}, false},
+		{"basic user with colon", UpstreamConfig{AuthType: AuthBasic, AuthUser: "a:b"}, false},
+		{"bearer without token", UpstreamConfig{AuthType: AuthBearer}, false},
+		{"bad auth type", UpstreamConfig{AuthType: "digest"}, false},
+		{"health path", UpstreamConfig{HealthPath: " /health "}, true},
+		{"relative health path", UpstreamConfig{HealthPath: "health"}, false},
+		{"health path with space", UpstreamConfig{HealthPath: "/a b"}, false},
+		{"negative interval", UpstreamConfig{HealthInterval: -1}, false},
+		{"negative max conns", UpstreamConfig{MaxConns: -1}, false},
+		{"negative breaker", UpstreamConfig{BreakerFailures: -1}, false},
+		{"negative breaker timeout", UpstreamConfig{BreakerTimeout: -1}, false},
+		{"origins", UpstreamConfig{Origins: []string{" https://a.com ", "", "http://b.com:8080/sub"}, Balance: BalanceRoundRobin}, true},
+		{"bad origin scheme", UpstreamConfig{Origins: []string{"ftp://a.com"}}, false},
+		{"origin without host", UpstreamConfig{Origins: []string{"http://"}}, false},
+		{"duplicate origin", UpstreamConfig{Origins: []string{"https://a.com", "https://a.com "}}, false},
+		{"bad balance", UpstreamConfig{Balance: "random"}, false},
+	}
+	for _, c := range cases {
+		upstream := c.upstream
+		err := validateUpstream(&upstream)
+		if (err == nil) != c.valid {
+			t.Errorf("%s: err = %v, want valid %v", c.name, err, c.valid)
+		}
+	}
+}
+
+func TestValidateUpstreamNormalizes(t *testing.T) {
+	upstream := UpstreamConfig{
+		Headers:      map[string]string{" x-token ": "abc"},
+		UserAgent:    " bot ",
+		HealthPath:   " /health ",
+		Origins:      []string{" https://a.com ", ""},
+		AuthUser:     "user",
+		AuthPassword: "pass",
+	}
+	if err := validateUpstream(&upstream); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.Headers["X-Token"] != "abc" || len(upstream.Headers) != 1 {
+		t.Errorf("headers = %v", upstream.Headers)
+	}
+	if upstream.UserAgent != "bot" || upstream.HealthPath != "/health" {
+		t.Errorf("user agent %q health path %q should be trimmed", upstream.UserAgent, upstream.HealthPath)
+	}
+	if len(upstream.Origins) != 1 || upstream.Origins[0] != "https://a.com" {
+		t.Errorf("origins = %v", upstream.Origins)
+	}
+	if upstream.CookiePolicy != CookiePass || upstream.Balance != BalanceFailover {
+		t.Errorf("defaults not set: %q %q", upstream.CookiePolicy, upstream.Balance)
+	}
+	//没有认证方式时清掉认证信息
+	if upstream.AuthUser != "" || upstream.AuthPassword != "" {
+		t.Error("auth fields should be cleared without auth_type")
+	}
+	empty := UpstreamConfig{}
+	if err := validateUpstream(&empty); err != nil || !empty.isZero() {
+		t.Error("validated empty upstream should stay zero")
+	}
+}
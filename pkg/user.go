@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"strings"
+)
+
+const (
+	RoleAdmin  = "admin"  //所有权限，包括基础配置和用户管理
+	RoleEditor = "editor" //查看所有站点，只能修改分配的域名
+	RoleViewer = "viewer" //只能查看站点和访问记录
+)
+
+var roleLevels = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+type AdminAccount struct {
+	Id           int      `json:"id"`
+	UserName     string   `json:"user_name"`
+	PasswordHash string   `json:"-"`
+	Role         string   `json:"role"`
+	Domains      []string `json:"domains"`
+	CreatedTime  int64    `json:"created_time"`
+}
+
+// HasRole 角色权限是否不低于 role
+func (account *AdminAccount) HasRole(role string) bool {
+	return account != nil && roleLevels[account.Role] >= roleLevels[role]
+}
+
+// CanEdit 是否可以修改域名，分配的域名包括它的子域名
+func (account *AdminAccount) CanEdit(domain string) bool {
+	if account == nil {
+		return false
+	}
+	if account.Role == RoleAdmin {
+		return true
+	}
+	if account.Role != RoleEditor {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return false
+	}
+	for _, grant := range account.Domains {
+		grant = strings.ToLower(grant)
+		if domain == grant || strings.HasSuffix(domain, "."+grant) {
+			return true
+		}
+	}
+	return false
+}
+
+func validRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}